@@ -2,7 +2,6 @@ package auth
 
 import (
 	"fmt"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -21,20 +20,32 @@ type AuthStore interface {
 	ResetPassword(username, plainPassword string) error
 
 	// ListUsers lists all information about the users
+	// The usernames are sorted in ascending order
 	// TODO: this could be very neat for the sysadmin, but probably a lot of metadata
 	// 		 about users is desired, and not just the usernames.
 	ListUsers() (usernames []string, err error)
 
 	// DeleteUser removes the username from the database entirely
+	// An error is returned if the user does not exist
 	DeleteUser(username string) error
 }
 
+// Pinger is an optional interface for an AuthStore that can cheaply check
+// that its backend is reachable
+type Pinger interface {
+	// Ping returns an error if the backend cannot be reached
+	Ping() error
+}
+
 // CheckPassword checks if the hash was the result of hashing this specific plainPassword
+// The hash is checked by the DefaultHasher
 func CheckPassword(plainPassword, hash []byte) bool {
-	return bcrypt.CompareHashAndPassword(hash, plainPassword) == nil
+	return DefaultHasher.Verify(plainPassword, hash)
 }
 
-// HashPassword hashes the plainPassword using the bcrypt.DefaultCost
+// HashPassword hashes the plainPassword using the DefaultHasher, which uses
+// bcrypt with the bcrypt.DefaultCost unless it is changed
+// The default hashes are plain bcrypt hashes without a {SCHEME} prefix
 func HashPassword(plainPassword []byte) ([]byte, error) {
-	return bcrypt.GenerateFromPassword(plainPassword, bcrypt.DefaultCost)
+	return DefaultHasher.Hash(plainPassword)
 }
@@ -7,20 +7,44 @@ import (
 	"github.com/alienscience/imapsrv/auth"
 	"github.com/boltdb/bolt"
 	"os"
+	"sort"
+	"time"
 )
 
 type BoltAuthStore struct {
 	connection *bolt.DB
+
+	// Hasher hashes and verifies passwords, auth.DefaultHasher is used if this is nil
+	Hasher auth.Hasher
 }
 
 var (
 	usersBucket = []byte("users")
 )
 
+// DefaultLockTimeout is how long NewBoltAuthStore waits for the database file
+// lock before giving up, e.g when another process has the database open
+const DefaultLockTimeout = 5 * time.Second
+
+// Option configures how NewBoltAuthStore opens the database
+type Option func(*bolt.Options)
+
+// LockTimeoutOption sets how long to wait for the database file lock
+func LockTimeoutOption(timeout time.Duration) Option {
+	return func(o *bolt.Options) {
+		o.Timeout = timeout
+	}
+}
+
 // NewBoltAuthStore creates a new auth store using BoltDB, at the specified file location
-func NewBoltAuthStore(filename string) (*BoltAuthStore, error) {
+func NewBoltAuthStore(filename string, options ...Option) (*BoltAuthStore, error) {
+	boltOptions := &bolt.Options{Timeout: DefaultLockTimeout}
+	for _, option := range options {
+		option(boltOptions)
+	}
+
 	// Open database
-	c, err := bolt.Open(filename, os.FileMode(600), nil)
+	c, err := bolt.Open(filename, os.FileMode(600), boltOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -38,11 +62,41 @@ func NewBoltAuthStore(filename string) (*BoltAuthStore, error) {
 		return nil, err
 	}
 
-	store := &BoltAuthStore{c}
+	store := &BoltAuthStore{connection: c}
 
 	return store, nil
 }
 
+// hasher gets the Hasher used for passwords
+func (b *BoltAuthStore) hasher() auth.Hasher {
+	if b.Hasher == nil {
+		return auth.DefaultHasher
+	}
+	return b.Hasher
+}
+
+// Close closes the underlying database
+func (b *BoltAuthStore) Close() error {
+	if b.connection == nil {
+		return auth.ErrNotConnected
+	}
+
+	err := b.connection.Close()
+	b.connection = nil
+	return err
+}
+
+// Ping checks that the database is open
+func (b *BoltAuthStore) Ping() error {
+	if b.connection == nil {
+		return auth.ErrNotConnected
+	}
+
+	return b.connection.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
 // Authenticate attempts to authenticate the given credentials
 func (b *BoltAuthStore) Authenticate(username, plainPassword string) (success bool, err error) {
 	// TODO: do we want this check here, or in a separate "IsAvailable" method in the interface?
@@ -64,7 +118,7 @@ func (b *BoltAuthStore) Authenticate(username, plainPassword string) (success bo
 		return false, fmt.Errorf("user %s not found", username)
 	}
 
-	return auth.CheckPassword([]byte(plainPassword), hashedPassword), nil
+	return b.hasher().Verify([]byte(plainPassword), hashedPassword), nil
 }
 
 // CreateUser creates a user with the given username
@@ -73,7 +127,7 @@ func (b *BoltAuthStore) CreateUser(username, plainPassword string) error {
 		return auth.ErrNotConnected
 	}
 
-	hashedPassword, err := auth.HashPassword([]byte(plainPassword))
+	hashedPassword, err := b.hasher().Hash([]byte(plainPassword))
 	if err != nil {
 		return err
 	}
@@ -85,24 +139,63 @@ func (b *BoltAuthStore) CreateUser(username, plainPassword string) error {
 	return err
 }
 
+// CreateUserWithHash creates a user with a password that has already been
+// hashed, e.g when importing users from another system
+// The hash is stored verbatim, so it must be in a format that the Hasher can
+// verify, such as a {SCHEME} prefixed hash for auth.DefaultHasher
+func (b *BoltAuthStore) CreateUserWithHash(username string, hash []byte) error {
+	if b.connection == nil {
+		return auth.ErrNotConnected
+	}
+
+	err := b.connection.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(usersBucket)
+		return buck.Put([]byte(username), hash)
+	})
+	return err
+}
+
 // ResetPassword resets the password for the given username
 func (b *BoltAuthStore) ResetPassword(username, plainPassword string) error {
 	if b.connection == nil {
 		return auth.ErrNotConnected
 	}
-	// TODO: implement
-	return nil
+
+	hashedPassword, err := b.hasher().Hash([]byte(plainPassword))
+	if err != nil {
+		return err
+	}
+
+	err = b.connection.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(usersBucket)
+		if buck.Get([]byte(username)) == nil {
+			return fmt.Errorf("user %s not found", username)
+		}
+		return buck.Put([]byte(username), hashedPassword)
+	})
+	return err
 }
 
-// ListUsers lists all information about the users
+// ListUsers lists all information about the users, sorted by username
 // TODO: this could be very neat for the sysadmin, but probably a lot of metadata
 // 		 about users is desired, and not just the usernames.
 func (b *BoltAuthStore) ListUsers() (usernames []string, err error) {
 	if b.connection == nil {
 		return []string{}, auth.ErrNotConnected
 	}
-	// TODO: implement
-	return []string{}, nil
+
+	usernames = make([]string, 0, 8)
+	err = b.connection.View(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(usersBucket)
+		return buck.ForEach(func(k, v []byte) error {
+			usernames = append(usernames, string(k))
+			return nil
+		})
+	})
+
+	// Bolt iterates in byte order, sort explicitly to honour the interface
+	sort.Strings(usernames)
+	return usernames, err
 }
 
 // DeleteUser removes the username from the database entirely
@@ -110,6 +203,13 @@ func (b *BoltAuthStore) DeleteUser(username string) error {
 	if b.connection == nil {
 		return auth.ErrNotConnected
 	}
-	// TODO: implement
-	return nil
+
+	err := b.connection.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(usersBucket)
+		if buck.Get([]byte(username)) == nil {
+			return fmt.Errorf("user %s not found", username)
+		}
+		return buck.Delete([]byte(username))
+	})
+	return err
 }
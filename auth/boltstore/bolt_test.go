@@ -0,0 +1,150 @@
+package boltstore
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tempDbFile returns the name of a temporary database file
+func tempDbFile(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "users.db")
+}
+
+func TestOpenLockedDatabase(t *testing.T) {
+	filename := tempDbFile(t)
+
+	store, err := NewBoltAuthStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// A second open must give up rather than wait forever for the lock
+	start := time.Now()
+	_, err = NewBoltAuthStore(filename, LockTimeoutOption(100*time.Millisecond))
+	if err == nil {
+		t.Error("Expected an error opening a locked database")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("Opening a locked database took too long")
+	}
+}
+
+func TestReopenClosedDatabase(t *testing.T) {
+	filename := tempDbFile(t)
+
+	for i := 0; i < 20; i++ {
+		store, err := NewBoltAuthStore(filename)
+		if err != nil {
+			t.Fatalf("Open %d failed, %v", i, err)
+		}
+
+		err = store.Close()
+		if err != nil {
+			t.Fatalf("Close %d failed, %v", i, err)
+		}
+	}
+
+	// Closing twice is an error, not a panic
+	store, _ := NewBoltAuthStore(filename)
+	store.Close()
+	if store.Close() == nil {
+		t.Error("Expected an error closing a closed store")
+	}
+}
+
+func TestListUsersSorted(t *testing.T) {
+	filename := tempDbFile(t)
+
+	store, err := NewBoltAuthStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for _, user := range []string{"mallory", "alice", "trent", "bob", "Zed"} {
+		err = store.CreateUser(user, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users, err := store.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"Zed", "alice", "bob", "mallory", "trent"}
+	if strings.Join(users, ",") != strings.Join(expected, ",") {
+		t.Errorf("Unexpected users %v", users)
+	}
+}
+
+func TestCreateUserWithHash(t *testing.T) {
+	filename := tempDbFile(t)
+
+	store, err := NewBoltAuthStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// An SSHA512 hash of "s3cret" made outside of imapsrv
+	hash := "{SSHA512}/vzwsseLJhqpvK6rDLVU8gkysU1Ra4GBBrKzEjEug7ftFBtEp9sC8Tb0LwgVoFeeUfGKIvpyyABYZFvIO/ud3zAxMjM0NTY3ODlhYmNkZWY="
+	err = store.CreateUserWithHash("alice", []byte(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	success, err := store.Authenticate("alice", "s3cret")
+	if err != nil || !success {
+		t.Errorf("Failed to authenticate with an imported hash, %v", err)
+	}
+
+	success, _ = store.Authenticate("alice", "wrong")
+	if success {
+		t.Error("Authenticated with the wrong password")
+	}
+}
+
+func TestDeleteUnknownUser(t *testing.T) {
+	filename := tempDbFile(t)
+
+	store, err := NewBoltAuthStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	err = store.CreateUser("alice", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.DeleteUser("bob") == nil {
+		t.Error("Expected an error deleting an unknown user")
+	}
+	if err = store.DeleteUser("alice"); err != nil {
+		t.Errorf("Failed to delete a user, %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	filename := tempDbFile(t)
+
+	store, err := NewBoltAuthStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.Ping(); err != nil {
+		t.Errorf("Expected an open store to respond, got %v", err)
+	}
+
+	store.Close()
+	if store.Ping() == nil {
+		t.Error("Expected an error pinging a closed store")
+	}
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hasher hashes and verifies passwords using a particular algorithm
+type Hasher interface {
+	// Hash hashes the plainPassword
+	Hash(plainPassword []byte) ([]byte, error)
+
+	// Verify checks if the hash was the result of hashing this plainPassword
+	Verify(plainPassword, hash []byte) bool
+}
+
+// DefaultHasher is the Hasher used by HashPassword and CheckPassword
+var DefaultHasher Hasher = NewSchemeHasher()
+
+// BcryptHasher hashes passwords with bcrypt
+type BcryptHasher struct {
+	// Cost is the bcrypt cost, 0 uses bcrypt.DefaultCost
+	Cost int
+}
+
+// Hash hashes the plainPassword with bcrypt
+func (h *BcryptHasher) Hash(plainPassword []byte) ([]byte, error) {
+	cost := h.Cost
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	return bcrypt.GenerateFromPassword(plainPassword, cost)
+}
+
+// Verify checks a bcrypt hash
+func (h *BcryptHasher) Verify(plainPassword, hash []byte) bool {
+	return bcrypt.CompareHashAndPassword(hash, plainPassword) == nil
+}
+
+// ssha512SaltSize is the size of the salt used by SSHA512Hasher
+const ssha512SaltSize = 16
+
+// SSHA512Hasher hashes passwords with salted SHA-512, in the format used by
+// the SSHA512 scheme of Dovecot and OpenLDAP
+// It is intended for importing existing hashes, bcrypt is the better choice
+// for new passwords
+type SSHA512Hasher struct{}
+
+// Hash hashes the plainPassword with a random salt
+func (h *SSHA512Hasher) Hash(plainPassword []byte) ([]byte, error) {
+	salt := make([]byte, ssha512SaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssha512(plainPassword, salt), nil
+}
+
+// Verify checks a salted SHA-512 hash
+func (h *SSHA512Hasher) Verify(plainPassword, hash []byte) bool {
+	decoded, err := base64.StdEncoding.DecodeString(string(hash))
+	if err != nil || len(decoded) <= sha512.Size {
+		return false
+	}
+
+	salt := decoded[sha512.Size:]
+	return subtle.ConstantTimeCompare(ssha512(plainPassword, salt), hash) == 1
+}
+
+// ssha512 gets the base64 encoded SHA-512 digest of the password and salt,
+// followed by the salt
+func ssha512(plainPassword, salt []byte) []byte {
+	digest := sha512.New()
+	digest.Write(plainPassword)
+	digest.Write(salt)
+
+	sum := append(digest.Sum(nil), salt...)
+	return []byte(base64.StdEncoding.EncodeToString(sum))
+}
+
+// SchemeHasher prefixes hashes with the name of their scheme, e.g {BCRYPT},
+// so that hashes from several algorithms can coexist, for instance while
+// migrating from another system
+type SchemeHasher struct {
+	// Default is the scheme used for new hashes, which are prefixed with
+	// {SCHEME}. If it is empty, new hashes use the Unprefixed scheme and have
+	// no prefix, so they can be read by versions that predate schemes
+	Default string
+	// Schemes are the hashers for each scheme name
+	Schemes map[string]Hasher
+	// Unprefixed is the scheme of hashes that have no prefix
+	Unprefixed string
+}
+
+// NewSchemeHasher creates a SchemeHasher that supports the BCRYPT and
+// SSHA512 schemes and uses unprefixed bcrypt for new hashes
+// Hashes without a prefix are treated as bcrypt hashes
+func NewSchemeHasher() *SchemeHasher {
+	return &SchemeHasher{
+		Schemes: map[string]Hasher{
+			"BCRYPT":  &BcryptHasher{},
+			"SSHA512": &SSHA512Hasher{},
+		},
+		Unprefixed: "BCRYPT",
+	}
+}
+
+// Hash hashes the plainPassword using the default scheme
+func (h *SchemeHasher) Hash(plainPassword []byte) ([]byte, error) {
+	if h.Default == "" {
+		hasher, ok := h.Schemes[h.Unprefixed]
+		if !ok {
+			return nil, fmt.Errorf("unknown password scheme %s", h.Unprefixed)
+		}
+		return hasher.Hash(plainPassword)
+	}
+
+	hasher, ok := h.Schemes[h.Default]
+	if !ok {
+		return nil, fmt.Errorf("unknown password scheme %s", h.Default)
+	}
+
+	hash, err := hasher.Hash(plainPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte("{"+h.Default+"}"), hash...), nil
+}
+
+// Verify checks the hash using the hasher for its scheme
+func (h *SchemeHasher) Verify(plainPassword, hash []byte) bool {
+	scheme, rest := splitScheme(hash)
+	if scheme == "" {
+		scheme = h.Unprefixed
+	}
+
+	hasher, ok := h.Schemes[scheme]
+	if !ok {
+		return false
+	}
+
+	return hasher.Verify(plainPassword, rest)
+}
+
+// splitScheme splits a hash into its scheme name and the hash itself
+// The scheme is empty if the hash does not have a {SCHEME} prefix
+func splitScheme(hash []byte) (string, []byte) {
+	if len(hash) == 0 || hash[0] != '{' {
+		return "", hash
+	}
+
+	end := bytes.IndexByte(hash, '}')
+	if end == -1 {
+		return "", hash
+	}
+
+	return string(hash[1:end]), hash[end+1:]
+}
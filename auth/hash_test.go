@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSchemeHasher(t *testing.T) {
+	for _, scheme := range []string{"BCRYPT", "SSHA512"} {
+		hasher := NewSchemeHasher()
+		hasher.Default = scheme
+
+		hash, err := hasher.Hash([]byte("s3cret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(hash), "{"+scheme+"}") {
+			t.Errorf("Expected a %s prefix, got %q", scheme, hash)
+		}
+
+		// Hashes from every scheme can be verified by the default hasher
+		if !DefaultHasher.Verify([]byte("s3cret"), hash) {
+			t.Errorf("Failed to verify a %s hash", scheme)
+		}
+		if DefaultHasher.Verify([]byte("wrong"), hash) {
+			t.Errorf("Verified a %s hash with the wrong password", scheme)
+		}
+	}
+}
+
+func TestSchemeHasherUnprefixed(t *testing.T) {
+	hash, err := (&BcryptHasher{}).Hash([]byte("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !CheckPassword([]byte("s3cret"), hash) {
+		t.Error("Failed to verify a bcrypt hash without a prefix")
+	}
+}
+
+func TestHashPasswordUnprefixed(t *testing.T) {
+	hash, err := HashPassword([]byte("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.HasPrefix(string(hash), "{") {
+		t.Errorf("Unexpected scheme prefix in %q", hash)
+	}
+	if !(&BcryptHasher{}).Verify([]byte("s3cret"), hash) {
+		t.Error("Expected a plain bcrypt hash")
+	}
+}
+
+func TestSSHA512Hasher(t *testing.T) {
+	// base64(sha512("s3cret" + salt) + salt) with the salt "0123456789abcdef"
+	hash := []byte("/vzwsseLJhqpvK6rDLVU8gkysU1Ra4GBBrKzEjEug7ftFBtEp9sC8Tb0LwgVoFeeUfGKIvpyyABYZFvIO/ud3zAxMjM0NTY3ODlhYmNkZWY=")
+
+	hasher := &SSHA512Hasher{}
+	if !hasher.Verify([]byte("s3cret"), hash) || hasher.Verify([]byte("wrong"), hash) {
+		t.Error("Unexpected SSHA512 verification")
+	}
+	if !CheckPassword([]byte("s3cret"), append([]byte("{SSHA512}"), hash...)) {
+		t.Error("Failed to verify a prefixed SSHA512 hash")
+	}
+}
+
+func TestUnknownScheme(t *testing.T) {
+	if CheckPassword([]byte("s3cret"), []byte("{UNKNOWN}s3cret")) {
+		t.Error("Verified a hash with an unknown scheme")
+	}
+}
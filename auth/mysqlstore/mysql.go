@@ -1,12 +1,18 @@
 // Package mysqlstore holds an implementation of github.com/alienscience/imapsrv/auth - AuthStore, using MySQL
 package mysqlstore
 
+import (
+	"github.com/alienscience/imapsrv/auth"
+)
+
 // TODO: implement all these functions for MySQL... but with which driver?
 // or do we want two packages, one for each driver:
 // go-sql-driver/mysql
 // ziutek/mymysql
 
 type MySQLAuthStore struct {
+	// Hasher hashes and verifies passwords, auth.DefaultHasher is used if this is nil
+	Hasher auth.Hasher
 }
 
 // Authenticate attempts to authenticate the given credentials
@@ -19,6 +25,11 @@ func (m *MySQLAuthStore) CreateUser(username, plainPassword string) error {
 	return nil
 }
 
+// CreateUserWithHash creates a user with a password that has already been hashed
+func (m *MySQLAuthStore) CreateUserWithHash(username string, hash []byte) error {
+	return nil
+}
+
 // ResetPassword resets the password for the given username
 func (m *MySQLAuthStore) ResetPassword(username, plainPassword string) error {
 	return nil
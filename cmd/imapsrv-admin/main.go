@@ -0,0 +1,93 @@
+// Command imapsrv-admin manages the users in a BoltDB authentication store
+//
+// Usage:
+//
+//	imapsrv-admin -db users.db adduser <username> <password>
+//	imapsrv-admin -db users.db passwd <username> <password>
+//	imapsrv-admin -db users.db deluser <username>
+//	imapsrv-admin -db users.db listusers
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/alienscience/imapsrv/auth"
+	"github.com/alienscience/imapsrv/auth/boltstore"
+	"log"
+	"os"
+)
+
+func main() {
+	dbFile := flag.String("db", "users.db", "BoltDB file holding the users")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	// Open the authentication store
+	store, err := boltstore.NewBoltAuthStore(*dbFile)
+	if err != nil {
+		log.Fatalln("Could not open", *dbFile, err)
+	}
+
+	// log.Fatalln skips deferred calls so close the store before exiting
+	err = run(store, args[0], args[1:])
+	closeErr := store.Close()
+	if err != nil {
+		log.Fatalln(args[0], err)
+	}
+	if closeErr != nil {
+		log.Fatalln("Could not close", *dbFile, closeErr)
+	}
+}
+
+// run executes an admin command against the given store
+func run(store auth.AuthStore, command string, args []string) error {
+	switch command {
+	case "adduser":
+		if len(args) != 2 {
+			return fmt.Errorf("expected <username> <password>")
+		}
+		return store.CreateUser(args[0], args[1])
+
+	case "passwd":
+		if len(args) != 2 {
+			return fmt.Errorf("expected <username> <password>")
+		}
+		return store.ResetPassword(args[0], args[1])
+
+	case "deluser":
+		if len(args) != 1 {
+			return fmt.Errorf("expected <username>")
+		}
+		return store.DeleteUser(args[0])
+
+	case "listusers":
+		users, err := store.ListUsers()
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			fmt.Println(user)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command")
+	}
+}
+
+// usage prints the command line usage
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: imapsrv-admin [-db file] command [arguments]")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  adduser <username> <password>")
+	fmt.Fprintln(os.Stderr, "  passwd <username> <password>")
+	fmt.Fprintln(os.Stderr, "  deluser <username>")
+	fmt.Fprintln(os.Stderr, "  listusers")
+	flag.PrintDefaults()
+}
@@ -1,9 +1,10 @@
 package imapsrv
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
 	"net/textproto"
 	"strings"
 )
@@ -42,25 +43,19 @@ type capability struct {
 func (c *capability) execute(s *session) *response {
 	var commands []string
 
-	switch s.listener.encryption {
-	case unencryptedLevel:
-		// TODO: do we want to support this?
-
-	case starttlsLevel:
-		if s.encryption == tlsLevel {
-			commands = append(commands, "AUTH=PLAIN")
-		} else {
-			commands = append(commands, "STARTTLS")
+	// LOGIN is implicit in IMAP4rev1, AUTHENTICATE is not supported so
+	// no AUTH= mechanisms are advertised
+	if s.listener.encryption == starttlsLevel && s.encryption != tlsLevel {
+		commands = append(commands, "STARTTLS")
+		if s.loginDisabled() {
 			commands = append(commands, "LOGINDISABLED")
 		}
-
-	case tlsLevel:
-		commands = append(commands, "AUTH=PLAIN")
 	}
+	commands = append(commands, "UNAUTHENTICATE")
 
 	// Return all capabilities
 	return ok(c.tag, "CAPABILITY completed").
-		extra("CAPABILITY IMAP4rev1 " + strings.Join(commands, " "))
+		extra(strings.Join(append([]string{"CAPABILITY", "IMAP4rev1"}, commands...), " "))
 }
 
 //------------------------------------------------------------------------------
@@ -70,12 +65,28 @@ type starttls struct {
 }
 
 func (c *starttls) execute(sess *session) *response {
-	sess.conn.Write([]byte(fmt.Sprintf("%s Begin TLS negotiation now", c.tag)))
 
-	sess.conn = tls.Server(sess.conn, &tls.Config{Certificates: sess.listener.certificates})
-	textConn := textproto.NewConn(sess.conn)
+	// Is STARTTLS available?
+	if sess.listener.encryption != starttlsLevel || sess.encryption == tlsLevel {
+		return bad(c.tag, "STARTTLS not available")
+	}
+
+	sess.conn.Write([]byte(c.tag + " OK Begin TLS negotiation now\r\n"))
+
+	// Negotiate TLS now so that a failure is not mistaken for a cleartext
+	// command - there is no way back to the unencrypted connection
+	// The handshake is abandoned if the session is closed or the client stalls
+	tlsConn := tls.Server(sess.conn, sess.listener.tlsConfig)
+	ctx, cancel := context.WithTimeout(sess.ctx, handshakeTimeout)
+	defer cancel()
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		sess.log("STARTTLS negotiation failed, ", err)
+		return empty().shouldClose()
+	}
 
-	sess.encryption = tlsLevel
+	sess.setTLS(tlsConn)
+	textConn := textproto.NewConn(sess.conn)
 	return empty().replaceBuffers(textConn)
 }
 
@@ -98,12 +109,31 @@ func (c *login) execute(sess *session) *response {
 		return bad(c.tag, message)
 	}
 
+	// Is plaintext authentication allowed?
+	if sess.loginDisabled() {
+		sess.log("LOGIN before STARTTLS")
+		return no(c.tag, "[PRIVACYREQUIRED] LOGIN disabled, use STARTTLS first")
+	}
+
 	auth, err := sess.server.config.authBackend.Authenticate(c.userId, c.password)
 	if auth {
+		// Does the user have too many sessions?
+		if !sess.server.claimUser(c.userId) {
+			sess.log("LOGIN too many connections for ", c.userId)
+			return no(c.tag, "[LIMIT] LOGIN too many connections for this user")
+		}
+
 		sess.st = authenticated
+		sess.user = c.userId
 		return ok(c.tag, "LOGIN completed")
 	}
-	log.Println("Login request:", auth, err)
+
+	// Log the failure without the credentials
+	if err != nil {
+		sess.log("LOGIN failure, ", err)
+	} else {
+		sess.log("LOGIN failure")
+	}
 
 	// Fail by default
 	return no(c.tag, "LOGIN failure")
@@ -127,6 +157,28 @@ func (c *logout) execute(sess *session) *response {
 
 //------------------------------------------------------------------------------
 
+// unauthenticate is an UNAUTHENTICATE command (RFC 8437)
+type unauthenticate struct {
+	tag string
+}
+
+// execute an UNAUTHENTICATE command
+func (c *unauthenticate) execute(sess *session) *response {
+
+	// Is the user authenticated?
+	if res := requireAuthenticated(sess, c.tag, "UNAUTHENTICATE"); res != nil {
+		return res
+	}
+
+	// Drop all per-user state so that none of it leaks to the next user
+	sess.close()
+	sess.mailbox = nil
+	sess.st = notAuthenticated
+	return ok(c.tag, "UNAUTHENTICATE completed")
+}
+
+//------------------------------------------------------------------------------
+
 // selectMailbox is a SELECT command
 type selectMailbox struct {
 	tag     string
@@ -137,22 +189,36 @@ type selectMailbox struct {
 func (c *selectMailbox) execute(sess *session) *response {
 
 	// Is the user authenticated?
-	if sess.st != authenticated {
-		return mustAuthenticate(sess, c.tag, "SELECT")
+	if res := requireAuthenticated(sess, c.tag, "SELECT"); res != nil {
+		return res
 	}
 
-	// Select the mailbox
+	// Any selected mailbox is closed, even if this SELECT fails
+	sess.mailbox = nil
+	sess.st = authenticated
+
+	// Check the mailbox name
 	mbox := pathToSlice(c.mailbox)
-	exists, err := sess.selectMailbox(mbox)
+	err := validatePath(mbox)
+	if err != nil {
+		return no(c.tag, "[CANNOT] SELECT "+err.Error())
+	}
+
+	// Select the mailbox
+	selected, err := sess.selectMailbox(mbox)
 
 	if err != nil {
 		return internalError(sess, c.tag, "SELECT", err)
 	}
 
-	if !exists {
+	if selected == nil {
 		return no(c.tag, "SELECT No such mailbox")
 	}
 
+	if !selected.Selectable() {
+		return no(c.tag, "[NONEXISTENT] SELECT Mailbox is not selectable")
+	}
+
 	// Build a response that includes mailbox information
 	res := ok(c.tag, "SELECT completed")
 
@@ -178,15 +244,16 @@ type list struct {
 func (c *list) execute(sess *session) *response {
 
 	// Is the user authenticated?
-	if sess.st != authenticated {
-		return mustAuthenticate(sess, c.tag, "LIST")
+	if res := requireAuthenticated(sess, c.tag, "LIST"); res != nil {
+		return res
 	}
 
 	// Is the mailbox pattern empty? This indicates that we should return
 	// the delimiter and the root name of the reference
 	if c.mboxPattern == "" {
 		res := ok(c.tag, "LIST completed")
-		res.extra(fmt.Sprintf(`LIST () "%s" %s`, pathDelimiter, c.reference))
+		res.extra(fmt.Sprintf(`LIST (\Noselect) "%s" %s`,
+			string(pathDelimiter), rootName(c.reference)))
 		return res
 	}
 
@@ -209,7 +276,7 @@ func (c *list) execute(sess *session) *response {
 	// Respond with the mailboxes
 	res := ok(c.tag, "LIST completed")
 	for _, mbox := range mboxes {
-		res.extra(fmt.Sprintf(`LIST (%s) "%s" /%s`,
+		res.extra(fmt.Sprintf(`LIST (%s) "%s" %s`,
 			joinMailboxFlags(mbox),
 			string(pathDelimiter),
 			strings.Join(mbox.Path, string(pathDelimiter))))
@@ -233,6 +300,21 @@ func (c *unknown) execute(s *session) *response {
 	return bad(c.tag, message)
 }
 
+//------------------------------------------------------------------------------
+
+// parseFailure is a command that could not be parsed
+type parseFailure struct {
+	tag string
+	err parseError
+}
+
+// execute reports an error for a command that could not be parsed
+func (c *parseFailure) execute(s *session) *response {
+	message := c.err.Error()
+	s.log(message)
+	return bad(c.tag, message)
+}
+
 //------ Helper functions ------------------------------------------------------
 
 // internalError logs an error and return an response
@@ -242,6 +324,16 @@ func internalError(sess *session, tag string, commandName string, err error) *re
 	return no(tag, message).shouldClose()
 }
 
+// requireAuthenticated checks that a command is allowed in the authenticated
+// and selected states, returning a BAD response if it is not
+func requireAuthenticated(sess *session, tag string, commandName string) *response {
+	if sess.st == notAuthenticated {
+		return mustAuthenticate(sess, tag, commandName)
+	}
+
+	return nil
+}
+
 // mustAuthenticate indicates a command is invalid because the user has not authenticated
 func mustAuthenticate(sess *session, tag string, commandName string) *response {
 	message := commandName + " not authenticated"
@@ -250,35 +342,53 @@ func mustAuthenticate(sess *session, tag string, commandName string) *response {
 }
 
 // pathToSlice converts a path to a slice of strings
+// Mailbox names are always relative to the root of the hierarchy, so leading
+// and trailing delimiters are ignored and both "" and "/" give the root,
+// which is an empty slice. Empty components inside the path are kept so
+// that they can be rejected by validatePath.
 func pathToSlice(path string) []string {
+	trimmed := strings.Trim(path, string(pathDelimiter))
+	if trimmed == "" {
+		return []string{}
+	}
 
-	// Split the path
-	ret := strings.Split(path, string(pathDelimiter))
+	return strings.Split(trimmed, string(pathDelimiter))
+}
 
-	if len(ret) == 0 {
-		return ret
+// rootName gets the name of the top level of the hierarchy that a
+// reference belongs to, as a quoted string
+func rootName(reference string) string {
+	path := pathToSlice(reference)
+	if len(path) == 0 {
+		return `""`
 	}
 
-	// Remove leading and trailing blanks
-	if ret[0] == "" {
-		if len(ret) > 1 {
-			ret = ret[1:]
-		} else {
-			return []string{}
-		}
+	return quoted(path[0])
+}
+
+// validatePath checks that a mailbox path can be used as a mailbox name
+func validatePath(path []string) error {
+
+	// The root of the hierarchy is not a mailbox
+	if len(path) == 0 {
+		return errors.New("empty mailbox name")
 	}
 
-	lastIndex := len(ret) - 1
-	if ret[lastIndex] == "" {
-		if len(ret) > 1 {
-			ret = ret[0:lastIndex]
-		} else {
-			return []string{}
+	for _, segment := range path {
+		// Reject empty segments e.g a//b
+		if segment == "" {
+			return errors.New("empty mailbox name segment")
 		}
-	}
 
-	return ret
+		// Reject control characters
+		for _, c := range segment {
+			if c < space || c == 0x7f {
+				return fmt.Errorf("invalid character %q in mailbox name", c)
+			}
+		}
+	}
 
+	return nil
 }
 
 // joinMailboxFlags returns a string of mailbox flags for the given mailbox
@@ -287,12 +397,13 @@ func joinMailboxFlags(m *Mailbox) string {
 	// Convert the mailbox flags into a slice of strings
 	flags := make([]string, 0, 4)
 
-	for flag, str := range mailboxFlags {
-		if m.Flags&flag != 0 {
-			flags = append(flags, str)
+	// Go through the flags in bit order so that the output is stable
+	for flag := uint8(1); flag != 0; flag <<= 1 {
+		if str, ok := mailboxFlags[flag]; ok && m.Flags&flag != 0 {
+			flags = append(flags, `\`+str)
 		}
 	}
 
 	// Return a joined string
-	return strings.Join(flags, ",")
+	return strings.Join(flags, " ")
 }
@@ -1,15 +1,19 @@
 package imapsrv
 
-import "testing"
-import "fmt"
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
 
 func setupTest() (*Server, *session) {
 	m := &TestMailstore{}
 	s := NewServer(
-		Store(m),
+		StoreOption(m),
 	)
 	//s.Start()
-	sess := createSession("1", s.config, s, nil, nil) // TODO: listener and net.Conn
+	l := &listener{encryption: starttlsLevel}
+	sess := createSession("1", s.config, s, l, nil) // TODO: net.Conn
 	return s, sess
 }
 
@@ -80,12 +84,43 @@ func TestCapabilityCommand(t *testing.T) {
 	cap := &capability{tag: "A00001"}
 	resp := cap.execute(session)
 	// TODO: STARTTLS shouldn't always be available? (i.e. after using STARTTLS)
-	if (resp.tag != "A00001") || (resp.message != "CAPABILITY completed") || (resp.untagged[0] != "CAPABILITY IMAP4rev1 STARTTLS") {
+	if (resp.tag != "A00001") || (resp.message != "CAPABILITY completed") || (resp.untagged[0] != "CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED UNAUTHENTICATE") {
 		t.Error("Capability Failed - unexpected response.")
 		fmt.Println(resp)
 	}
 }
 
+// TestListenerCapabilities tests the capabilities advertised by each type of listener
+func TestListenerCapabilities(t *testing.T) {
+	tests := []struct {
+		listener   listener
+		encryption encryptionLevel
+		expected   string
+	}{
+		{listener{encryption: unencryptedLevel}, unencryptedLevel,
+			"CAPABILITY IMAP4rev1 UNAUTHENTICATE"},
+		{listener{encryption: starttlsLevel}, unencryptedLevel,
+			"CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED UNAUTHENTICATE"},
+		{listener{encryption: starttlsLevel, allowPlainAuth: true}, unencryptedLevel,
+			"CAPABILITY IMAP4rev1 STARTTLS UNAUTHENTICATE"},
+		{listener{encryption: starttlsLevel}, tlsLevel,
+			"CAPABILITY IMAP4rev1 UNAUTHENTICATE"},
+		{listener{encryption: tlsLevel}, tlsLevel,
+			"CAPABILITY IMAP4rev1 UNAUTHENTICATE"},
+	}
+
+	for _, test := range tests {
+		_, session := setupTest()
+		session.listener = &test.listener
+		session.encryption = test.encryption
+
+		resp := (&capability{tag: "A00009"}).execute(session)
+		if resp.untagged[0] != test.expected {
+			t.Errorf("Unexpected capabilities %q, expected %q", resp.untagged[0], test.expected)
+		}
+	}
+}
+
 // TestLogoutCommand tests the correctness of the LOGOUT command
 func TestLogoutCommand(t *testing.T) {
 	_, session := setupTest()
@@ -96,3 +131,387 @@ func TestLogoutCommand(t *testing.T) {
 		fmt.Println(resp)
 	}
 }
+
+// modSeqMailstore is a dummy mailstore that keeps a modification sequence
+type modSeqMailstore struct {
+	TestMailstore
+	modSeq uint64
+}
+
+// HighestModSeq gets a dummy modification sequence
+func (m *modSeqMailstore) HighestModSeq(mbox int64) (uint64, error) {
+	return m.modSeq, nil
+}
+
+// TestSelectHighestModSeq tests that SELECT reports HIGHESTMODSEQ when the mailstore supports it
+func TestSelectHighestModSeq(t *testing.T) {
+	_, session := setupTest()
+	session.st = authenticated
+	sel := &selectMailbox{tag: "A00002", mailbox: "inbox"}
+
+	// The default mailstore does not keep modification sequences
+	resp := sel.execute(session)
+	for _, line := range resp.untagged {
+		if strings.Contains(line, "HIGHESTMODSEQ") {
+			t.Errorf("Unexpected %q", line)
+		}
+	}
+
+	m := &modSeqMailstore{modSeq: 42}
+	session.config.mailstore = m
+	session.st = authenticated
+	resp = sel.execute(session)
+	if resp.condition != "OK" || resp.untagged[len(resp.untagged)-1] != "OK [HIGHESTMODSEQ 42] Highest" {
+		t.Errorf("Unexpected SELECT response %v", resp)
+	}
+}
+
+// TestSelectInvalidPath tests that SELECT rejects malformed mailbox names
+func TestSelectInvalidPath(t *testing.T) {
+	_, session := setupTest()
+
+	for _, name := range []string{"a//b", "in\tbox", "a/b\r\nc", "", "/"} {
+		session.st = authenticated
+		sel := &selectMailbox{tag: "A00003", mailbox: name}
+		resp := sel.execute(session)
+		if resp.condition != "NO" || !strings.HasPrefix(resp.message, "[CANNOT]") {
+			t.Errorf("Expected SELECT %q to be rejected, got %v", name, resp)
+		}
+	}
+
+	// Leading and trailing delimiters are allowed
+	session.st = authenticated
+	sel := &selectMailbox{tag: "A00003", mailbox: "/inbox/"}
+	resp := sel.execute(session)
+	if resp.condition != "OK" {
+		t.Errorf("Expected SELECT to succeed, got %v", resp)
+	}
+}
+
+// noselectMailstore is a dummy mailstore where every mailbox has the Noselect flag
+type noselectMailstore struct {
+	TestMailstore
+}
+
+// GetMailbox gets a dummy Noselect mailbox
+func (m *noselectMailstore) GetMailbox(path []string) (*Mailbox, error) {
+	return &Mailbox{
+		Name:  "parent",
+		Path:  []string{"parent"},
+		Id:    5,
+		Flags: Noselect,
+	}, nil
+}
+
+// TestSelectNoselect tests that a Noselect mailbox cannot be selected
+func TestSelectNoselect(t *testing.T) {
+	_, session := setupTest()
+	session.config.mailstore = &noselectMailstore{}
+	session.st = authenticated
+
+	sel := &selectMailbox{tag: "A00004", mailbox: "parent"}
+	resp := sel.execute(session)
+	if resp.condition != "NO" || !strings.HasPrefix(resp.message, "[NONEXISTENT]") {
+		t.Errorf("Unexpected SELECT response %v", resp)
+	}
+
+	if session.mailbox != nil || session.st != authenticated {
+		t.Error("The session state changed")
+	}
+}
+
+// TestMailboxSelectable tests the selectability of mailboxes
+func TestMailboxSelectable(t *testing.T) {
+	noselect, _ := (&noselectMailstore{}).GetMailbox([]string{"parent"})
+	if noselect.Selectable() {
+		t.Error("Expected a Noselect mailbox not to be selectable")
+	}
+
+	inbox, _ := (&TestMailstore{}).GetMailbox([]string{"inbox"})
+	if !inbox.Selectable() {
+		t.Error("Expected INBOX to be selectable")
+	}
+}
+
+// emptyMailstore is a dummy mailstore that has no mailboxes
+type emptyMailstore struct {
+	TestMailstore
+}
+
+// GetMailbox returns nil as the mailbox does not exist
+func (m *emptyMailstore) GetMailbox(path []string) (*Mailbox, error) {
+	return nil, nil
+}
+
+// TestMissingMailbox tests commands against a mailstore that returns no mailbox
+func TestMissingMailbox(t *testing.T) {
+	_, session := setupTest()
+	session.config.mailstore = &emptyMailstore{}
+	session.st = authenticated
+
+	sel := &selectMailbox{tag: "A00005", mailbox: "missing"}
+	resp := sel.execute(session)
+	if resp.condition != "NO" {
+		t.Errorf("Unexpected SELECT response %v", resp)
+	}
+
+	lst := &list{tag: "A00006", reference: "", mboxPattern: "missing"}
+	resp = lst.execute(session)
+	if resp.condition != "NO" || len(resp.untagged) != 0 {
+		t.Errorf("Unexpected LIST response %v", resp)
+	}
+}
+
+// statusMailstore is a dummy mailstore that reads the counters of a mailbox
+// in one call, and counts its calls
+type statusMailstore struct {
+	TestMailstore
+	// mailboxes maps mailbox names to ids, the TestMailstore mailbox is used if nil
+	mailboxes map[string]int64
+	// status holds the counters of each mailbox id
+	status      map[int64]MailboxStatus
+	statusCalls int
+}
+
+// GetMailbox gets a mailbox by name
+func (m *statusMailstore) GetMailbox(path []string) (*Mailbox, error) {
+	if m.mailboxes == nil {
+		return m.TestMailstore.GetMailbox(path)
+	}
+
+	id, ok := m.mailboxes[strings.Join(path, "/")]
+	if !ok {
+		return nil, nil
+	}
+	return &Mailbox{Name: path[len(path)-1], Path: path, Id: id}, nil
+}
+
+// MailboxStatus gets the dummy counters of a mailbox
+func (m *statusMailstore) MailboxStatus(mbox int64) (*MailboxStatus, error) {
+	m.statusCalls += 1
+	status, ok := m.status[mbox]
+	if !ok {
+		return nil, fmt.Errorf("no status for mailbox %d", mbox)
+	}
+	return &status, nil
+}
+
+// FirstUnseen must not be called when MailboxStatus is available
+func (m *statusMailstore) FirstUnseen(mbox int64) (int64, error) {
+	panic("FirstUnseen called")
+}
+
+// TestSelectMailboxStatus tests that SELECT reads the counters in a single call
+func TestSelectMailboxStatus(t *testing.T) {
+	tests := []struct {
+		status   MailboxStatus
+		expected []string
+	}{
+		{MailboxStatus{FirstUnseen: 2, TotalMessages: 3, RecentMessages: 1, NextUid: 20},
+			[]string{
+				"3 EXISTS",
+				"1 RECENT",
+				"OK [UNSEEN 2] Message 2 is first unseen",
+				"OK [UIDVALIDITY 1] UIDs valid",
+				"OK [UIDNEXT 20] Predicted next UID",
+			}},
+		// An empty mailbox has no first unseen message
+		{MailboxStatus{FirstUnseen: -1, TotalMessages: 0, RecentMessages: 0, NextUid: 1},
+			[]string{
+				"0 EXISTS",
+				"0 RECENT",
+				"OK [UIDVALIDITY 1] UIDs valid",
+				"OK [UIDNEXT 1] Predicted next UID",
+			}},
+	}
+
+	for _, test := range tests {
+		_, session := setupTest()
+		m := &statusMailstore{status: map[int64]MailboxStatus{1: test.status}}
+		session.config.mailstore = m
+		session.st = authenticated
+
+		sel := &selectMailbox{tag: "A00007", mailbox: "inbox"}
+		resp := sel.execute(session)
+
+		if resp.condition != "OK" || strings.Join(resp.untagged, "|") != strings.Join(test.expected, "|") {
+			t.Errorf("Unexpected SELECT response %v", resp)
+		}
+		if m.statusCalls != 1 {
+			t.Errorf("Expected one MailboxStatus call, got %d", m.statusCalls)
+		}
+	}
+}
+
+func TestPathToSlice(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{"", []string{}},
+		{"/", []string{}},
+		{"//", []string{}},
+		{"inbox", []string{"inbox"}},
+		{"/inbox/", []string{"inbox"}},
+		{"inbox/starred", []string{"inbox", "starred"}},
+		{"inbox//starred", []string{"inbox", "", "starred"}},
+	}
+
+	for _, test := range tests {
+		result := pathToSlice(test.path)
+		if fmt.Sprint(result) != fmt.Sprint(test.expected) || result == nil {
+			t.Errorf("pathToSlice(%q) = %q, expected %q", test.path, result, test.expected)
+		}
+	}
+}
+
+// listMailstore is a dummy mailstore with an INBOX hierarchy
+type listMailstore struct {
+	TestMailstore
+}
+
+// GetMailboxes lists the dummy hierarchy
+func (m *listMailstore) GetMailboxes(path []string) ([]*Mailbox, error) {
+	switch {
+	case len(path) == 0:
+		return []*Mailbox{
+			{Name: "INBOX", Path: []string{"INBOX"}, Id: 1},
+			{Name: "spam", Path: []string{"spam"}, Id: 2},
+		}, nil
+	case len(path) == 1 && path[0] == "INBOX":
+		return []*Mailbox{
+			{Name: "starred", Path: []string{"INBOX", "starred"}, Id: 3},
+		}, nil
+	default:
+		return []*Mailbox{}, nil
+	}
+}
+
+func TestListRoot(t *testing.T) {
+	_, session := setupTest()
+	session.config.mailstore = &listMailstore{}
+	session.st = authenticated
+
+	tests := []struct {
+		reference string
+		pattern   string
+		expected  []string
+	}{
+		{"", "*", []string{
+			`LIST () "/" INBOX`,
+			`LIST () "/" INBOX/starred`,
+			`LIST () "/" spam`}},
+		{"", "%", []string{
+			`LIST () "/" INBOX`,
+			`LIST () "/" spam`}},
+		{"/", "%", []string{
+			`LIST () "/" INBOX`,
+			`LIST () "/" spam`}},
+		{"INBOX", "%", []string{
+			`LIST () "/" INBOX/starred`}},
+		{"", "", []string{
+			`LIST (\Noselect) "/" ""`}},
+		{"INBOX/stared", "", []string{
+			`LIST (\Noselect) "/" "INBOX"`}},
+	}
+
+	for _, test := range tests {
+		lst := &list{tag: "A00007", reference: test.reference, mboxPattern: test.pattern}
+		resp := lst.execute(session)
+		if resp.condition != "OK" ||
+			strings.Join(resp.untagged, "\n") != strings.Join(test.expected, "\n") {
+			t.Errorf("LIST %q %q: unexpected response %v", test.reference, test.pattern, resp)
+		}
+	}
+}
+
+// TestWrongState tests commands issued in states where they are not allowed
+func TestWrongState(t *testing.T) {
+	tests := []struct {
+		st        state
+		cmd       command
+		condition string
+	}{
+		{notAuthenticated, &selectMailbox{tag: "A1", mailbox: "inbox"}, "BAD"},
+		{notAuthenticated, &list{tag: "A2", reference: "", mboxPattern: "*"}, "BAD"},
+		{notAuthenticated, &unauthenticate{tag: "A3"}, "BAD"},
+		{authenticated, &login{tag: "A4", userId: "test", password: "test"}, "BAD"},
+		{selected, &login{tag: "A5", userId: "test", password: "test"}, "BAD"},
+
+		// Authenticated state commands are also valid in the selected state
+		{selected, &selectMailbox{tag: "A6", mailbox: "inbox"}, "OK"},
+		{selected, &list{tag: "A7", reference: "", mboxPattern: "*"}, "OK"},
+		{selected, &unauthenticate{tag: "A8"}, "OK"},
+	}
+
+	for _, test := range tests {
+		_, session := setupTest()
+		session.st = test.st
+
+		resp := test.cmd.execute(session)
+		if resp.condition != test.condition {
+			t.Errorf("Unexpected response in state %d %v", test.st, resp)
+		}
+	}
+}
+
+func TestJoinMailboxFlags(t *testing.T) {
+	tests := []struct {
+		flags    uint8
+		expected string
+	}{
+		{0, ""},
+		{Noselect, `\Noselect`},
+		{Unmarked | Noinferiors, `\Noinferiors \Unmarked`},
+		{Marked | Noselect | Noinferiors, `\Noinferiors \Noselect \Marked`},
+	}
+
+	for _, test := range tests {
+		// Repeat to catch an unstable order
+		for i := 0; i < 10; i++ {
+			result := joinMailboxFlags(&Mailbox{Flags: test.flags})
+			if result != test.expected {
+				t.Fatalf("Unexpected flags %q, expected %q", result, test.expected)
+			}
+		}
+	}
+}
+
+// TestSelectTwice tests selecting one mailbox after another
+func TestSelectTwice(t *testing.T) {
+	_, session := setupTest()
+	session.config.mailstore = &statusMailstore{
+		mailboxes: map[string]int64{"inbox": 1, "spam": 2},
+		status: map[int64]MailboxStatus{
+			1: {FirstUnseen: 1, TotalMessages: 10, RecentMessages: 1, NextUid: 100},
+			2: {FirstUnseen: 2, TotalMessages: 20, RecentMessages: 2, NextUid: 200},
+		},
+	}
+	session.st = authenticated
+
+	resp := (&selectMailbox{tag: "A1", mailbox: "inbox"}).execute(session)
+	if resp.condition != "OK" || resp.untagged[0] != "10 EXISTS" {
+		t.Fatalf("Unexpected SELECT response %v", resp)
+	}
+
+	resp = (&selectMailbox{tag: "A2", mailbox: "spam"}).execute(session)
+	expected := []string{
+		"20 EXISTS",
+		"2 RECENT",
+		"OK [UNSEEN 2] Message 2 is first unseen",
+		"OK [UIDVALIDITY 2] UIDs valid",
+		"OK [UIDNEXT 200] Predicted next UID",
+	}
+	if resp.condition != "OK" || strings.Join(resp.untagged, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected SELECT response %v", resp)
+	}
+	if session.st != selected || session.mailbox.Id != 2 {
+		t.Errorf("Unexpected session state %d, mailbox %v", session.st, session.mailbox)
+	}
+
+	// A failed SELECT leaves no mailbox selected
+	resp = (&selectMailbox{tag: "A3", mailbox: "missing"}).execute(session)
+	if resp.condition != "NO" || session.st != authenticated || session.mailbox != nil {
+		t.Errorf("Unexpected state after a failed SELECT %v", resp)
+	}
+}
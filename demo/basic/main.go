@@ -2,7 +2,6 @@ package main
 
 import (
 	imap "github.com/alienscience/imapsrv"
-	"log"
 )
 
 func main() {
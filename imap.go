@@ -3,16 +3,27 @@ package imapsrv
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/alienscience/imapsrv/auth"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // DefaultListener is the listener that is used if no listener is specified
 const DefaultListener = "0.0.0.0:143"
 
+// shutdownTimeout limits the time a client has to accept pending output during shutdown
+const shutdownTimeout = time.Second
+
+// handshakeTimeout limits the time a client has to complete a TLS handshake
+const handshakeTimeout = 10 * time.Second
+
 // config is an IMAP server configuration
 type config struct {
 	maxClients uint
@@ -20,16 +31,41 @@ type config struct {
 	mailstore  Mailstore
 
 	authBackend auth.AuthStore
+
+	// tlsMinVersion is the minimum TLS version accepted by default
+	tlsMinVersion uint16
+	// tlsCipherSuites are the TLS cipher suites allowed by default, nil for Go's defaults
+	tlsCipherSuites []uint16
+	// requireTLS refuses most commands on STARTTLS listeners until TLS is negotiated
+	requireTLS bool
+	// maxConnectionsPerUser limits the sessions of an authenticated user, 0 is unlimited
+	maxConnectionsPerUser uint
+	// writeTimeout limits the time taken to write a response, 0 is unlimited
+	writeTimeout time.Duration
+	// maxLineLength limits the length of a command line, 0 is unlimited
+	maxLineLength int
+	// reusePort sets SO_REUSEPORT on the listening sockets
+	reusePort bool
+	// slowCommandThreshold is the execution time above which a command is
+	// logged as slow, 0 disables this
+	slowCommandThreshold time.Duration
+	// heartbeatInterval is the time between progress responses during a
+	// command, 0 disables these
+	heartbeatInterval time.Duration
 }
 
 type option func(*Server) error
 
 // listener represents a listener as used by the server
 type listener struct {
-	addr         string
-	encryption   encryptionLevel
-	certificates []tls.Certificate
-	listener     net.Listener
+	addr       string
+	encryption encryptionLevel
+	tlsConfig  *tls.Config
+	listener   net.Listener
+	// reloaded holds a *tls.Certificate set by ReloadTLS
+	reloaded *atomic.Value
+	// allowPlainAuth allows LOGIN before STARTTLS
+	allowPlainAuth bool
 }
 
 // Server is an IMAP Server
@@ -38,6 +74,16 @@ type Server struct {
 	config *config
 	// Number of active clients
 	activeClients uint
+	// mu protects the fields below
+	mu sync.Mutex
+	// clients are the currently connected clients
+	clients map[*client]struct{}
+	// stopping is set once the server has been asked to stop
+	stopping bool
+	// userSessions counts the authenticated sessions of each user
+	userSessions map[string]uint
+	// handledConns counts the connections passed to HandleConn
+	handledConns uint
 }
 
 // client is an IMAP Client as seen by an IMAP server
@@ -51,13 +97,25 @@ type client struct {
 	bufout *bufio.Writer
 	id     string
 	config *config
+
+	// mu serialises writes to bufout
+	mu sync.Mutex
+	// ctx is cancelled when the client is disconnected
+	ctx    context.Context
+	cancel context.CancelFunc
+	// closing is set when the server is disconnecting this client
+	closing bool
+	// greeted is set once the greeting has been sent, before then the
+	// client is not sent a BYE
+	greeted bool
 }
 
 // defaultConfig returns the default server configuration
 func defaultConfig() *config {
 	return &config{
-		listeners:  make([]listener, 0, 4),
-		maxClients: 8,
+		listeners:     make([]listener, 0, 4),
+		maxClients:    8,
+		tlsMinVersion: tls.VersionTLS12,
 	}
 }
 
@@ -93,24 +151,223 @@ func ListenOption(Addr string) option {
 func ListenSTARTTLSOoption(Addr, certFile, keyFile string) option {
 	return func(s *Server) error {
 		// Load the ceritificates
-		var err error
-		certs := make([]tls.Certificate, 1)
-		certs[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+		tlsConfig, err := loadTLSConfig(certFile, keyFile)
 		if err != nil {
 			return err
 		}
 
-		// Set up the listener
+		return ListenSTARTTLSConfigOption(Addr, tlsConfig)(s)
+	}
+}
+
+// ListenSTARTTLSConfigOption enables STARTTLS with the given TLS configuration
+// This allows certificates to be supplied from memory or by a GetCertificate callback
+func ListenSTARTTLSConfigOption(Addr string, tlsConfig *tls.Config) option {
+	return func(s *Server) error {
 		l := listener{
-			addr:         Addr,
-			encryption:   starttlsLevel,
-			certificates: certs,
+			addr:       Addr,
+			encryption: starttlsLevel,
+			tlsConfig:  tlsConfig,
+		}
+
+		// Certificates can be reloaded unless they come from a callback
+		if tlsConfig.GetCertificate == nil {
+			l.reloaded = new(atomic.Value)
 		}
 		s.config.listeners = append(s.config.listeners, l)
 		return nil
 	}
 }
 
+// ListenTLSOption adds an interface that only accepts TLS connections, using
+// the given certificate and keyfile
+func ListenTLSOption(Addr, certFile, keyFile string) option {
+	return func(s *Server) error {
+		tlsConfig, err := loadTLSConfig(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+
+		return ListenTLSConfigOption(Addr, tlsConfig)(s)
+	}
+}
+
+// ListenTLSConfigOption adds an interface that only accepts TLS connections,
+// using the given TLS configuration
+func ListenTLSConfigOption(Addr string, tlsConfig *tls.Config) option {
+	return func(s *Server) error {
+		l := listener{
+			addr:       Addr,
+			encryption: tlsLevel,
+			tlsConfig:  tlsConfig,
+		}
+
+		// Certificates can be reloaded unless they come from a callback
+		if tlsConfig.GetCertificate == nil {
+			l.reloaded = new(atomic.Value)
+		}
+		s.config.listeners = append(s.config.listeners, l)
+		return nil
+	}
+}
+
+// serverTLSConfig returns the TLS configuration for a listener with the
+// server wide defaults applied
+func (c *config) serverTLSConfig(l *listener) *tls.Config {
+	tlsConfig := l.tlsConfig
+	if tlsConfig == nil {
+		return nil
+	}
+
+	ret := tlsConfig.Clone()
+
+	// Use a certificate set by ReloadTLS in preference to the configured ones
+	if l.reloaded != nil {
+		reloaded := l.reloaded
+		certs := ret.Certificates
+		ret.Certificates = nil
+		ret.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if cert, ok := reloaded.Load().(*tls.Certificate); ok {
+				return cert, nil
+			}
+			return selectCertificate(hello, certs)
+		}
+	}
+
+	if ret.MinVersion == 0 {
+		ret.MinVersion = c.tlsMinVersion
+	}
+	if ret.CipherSuites == nil {
+		ret.CipherSuites = c.tlsCipherSuites
+	}
+	return ret
+}
+
+// selectCertificate chooses the certificate that suits the client, the first
+// certificate is the default
+func selectCertificate(hello *tls.ClientHelloInfo, certs []tls.Certificate) (*tls.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("IMAP has no TLS certificate")
+	}
+
+	for i := range certs {
+		if hello.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i], nil
+		}
+	}
+
+	return &certs[0], nil
+}
+
+// loadTLSConfig creates a TLS configuration from a certificate and keyfile
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// AllowPlainAuthOption allows LOGIN without TLS on the STARTTLS listener with
+// the given address, e.g a loopback listener behind a trusted proxy
+// This option must come after the option that adds the listener
+func AllowPlainAuthOption(Addr string) option {
+	return func(s *Server) error {
+		for i, iface := range s.config.listeners {
+			if iface.addr == Addr {
+				s.config.listeners[i].allowPlainAuth = true
+				return nil
+			}
+		}
+		return fmt.Errorf("IMAP has no listener on %s", Addr)
+	}
+}
+
+// TLSMinVersionOption sets the minimum TLS version for listeners whose TLS
+// configuration does not set one, the default is TLS 1.2
+func TLSMinVersionOption(version uint16) option {
+	return func(s *Server) error {
+		s.config.tlsMinVersion = version
+		return nil
+	}
+}
+
+// TLSCipherSuitesOption restricts the TLS cipher suites for listeners whose
+// TLS configuration does not set them
+func TLSCipherSuitesOption(suites []uint16) option {
+	return func(s *Server) error {
+		s.config.tlsCipherSuites = suites
+		return nil
+	}
+}
+
+// RequireTLSOption refuses all commands except CAPABILITY, STARTTLS, NOOP and
+// LOGOUT on STARTTLS listeners until TLS has been negotiated
+func RequireTLSOption() option {
+	return func(s *Server) error {
+		s.config.requireTLS = true
+		return nil
+	}
+}
+
+// MaxConnectionsPerUserOption limits the number of simultaneous sessions of
+// each authenticated user, the default of 0 is unlimited
+func MaxConnectionsPerUserOption(max uint) option {
+	return func(s *Server) error {
+		s.config.maxConnectionsPerUser = max
+		return nil
+	}
+}
+
+// WriteTimeoutOption sets how long a response can take to write before a
+// slow client is disconnected, the default of 0 waits forever
+func WriteTimeoutOption(timeout time.Duration) option {
+	return func(s *Server) error {
+		s.config.writeTimeout = timeout
+		return nil
+	}
+}
+
+// MaxLineLengthOption sets the maximum length of a command line, not
+// counting literals, clients sending longer lines are disconnected. The
+// default of 0 allows lines of any length.
+func MaxLineLengthOption(max int) option {
+	return func(s *Server) error {
+		s.config.maxLineLength = max
+		return nil
+	}
+}
+
+// ReusePortOption binds listeners with SO_REUSEPORT so that a new server
+// process can listen on the same addresses before the old one exits
+// This is supported on Linux, darwin and the BSDs
+func ReusePortOption() option {
+	return func(s *Server) error {
+		s.config.reusePort = true
+		return nil
+	}
+}
+
+// SlowCommandThresholdOption logs a warning for commands that take longer
+// than the threshold to execute, the default of 0 disables this
+func SlowCommandThresholdOption(threshold time.Duration) option {
+	return func(s *Server) error {
+		s.config.slowCommandThreshold = threshold
+		return nil
+	}
+}
+
+// HeartbeatIntervalOption sends an untagged OK response at the given
+// interval while a command executes, so that clients waiting on a long
+// command do not time out. The default of 0 disables this.
+func HeartbeatIntervalOption(interval time.Duration) option {
+	return func(s *Server) error {
+		s.config.heartbeatInterval = interval
+		return nil
+	}
+}
+
 // MaxClientsOption sets the MaxClients config
 func MaxClientsOption(max uint) option {
 	return func(s *Server) error {
@@ -122,7 +379,10 @@ func MaxClientsOption(max uint) option {
 // NewServer creates a new server with the given options
 func NewServer(options ...option) *Server {
 	// set the default config
-	s := &Server{}
+	s := &Server{
+		clients:      make(map[*client]struct{}),
+		userSessions: make(map[string]uint),
+	}
 	s.config = defaultConfig()
 
 	// override the config with the functional options
@@ -137,23 +397,162 @@ func NewServer(options ...option) *Server {
 }
 
 // Start an IMAP server
+// This blocks until the server is stopped, see ListenAndServe for a non-blocking alternative
 func (s *Server) Start() error {
+	err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	s.serve()
+	return nil
+}
+
+// ListenAndServe starts an IMAP server in the background
+// It returns once the server is listening, the caller is responsible for calling Stop
+func (s *Server) ListenAndServe() error {
+	err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	go s.serve()
+	return nil
+}
+
+// Stop closes the listeners and disconnects all clients with a BYE
+func (s *Server) Stop() error {
+	s.mu.Lock()
+	s.stopping = true
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	// Stop accepting new connections
+	var err error
+	for _, iface := range s.config.listeners {
+		if iface.listener == nil {
+			continue
+		}
+		e := iface.listener.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+
+	// Say goodbye to the connected clients
+	for _, c := range clients {
+		c.shutdown("Server shutting down")
+	}
+
+	return err
+}
+
+// Close stops the server, see Stop
+// The mailstore and authentication backend belong to the caller and are not closed
+func (s *Server) Close() error {
+	return s.Stop()
+}
+
+// ReloadTLS replaces the certificate used by the listener on the given address
+// New connections use the new certificate, existing connections are unaffected
+func (s *Server) ReloadTLS(Addr, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	for _, iface := range s.config.listeners {
+		if iface.addr != Addr || iface.tlsConfig == nil {
+			continue
+		}
+		if iface.reloaded == nil {
+			return fmt.Errorf("IMAP listener %s uses its own GetCertificate", Addr)
+		}
+		iface.reloaded.Store(&cert)
+		return nil
+	}
+
+	return fmt.Errorf("IMAP has no TLS listener on %s", Addr)
+}
+
+// Healthy returns an error if the server is not able to serve clients
+// It checks that the server is listening and that the backends respond, the
+// authentication backend is only checked if it implements auth.Pinger
+func (s *Server) Healthy() error {
+	if s.isStopping() {
+		return errors.New("IMAP server stopped")
+	}
+
+	// Check the listeners
+	if len(s.config.listeners) == 0 {
+		return errors.New("IMAP server not listening")
+	}
+	for _, iface := range s.config.listeners {
+		if iface.listener == nil {
+			return fmt.Errorf("IMAP server not listening on %s", iface.addr)
+		}
+	}
+
+	// Probe the mailstore
+	if s.config.mailstore != nil {
+		_, err := s.config.mailstore.GetMailboxes([]string{})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Probe the authentication backend
+	if pinger, ok := s.config.authBackend.(auth.Pinger); ok {
+		err := pinger.Ping()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listen opens the listeners
+func (s *Server) listen() error {
 	// Use a default listener if none exist
 	if len(s.config.listeners) == 0 {
 		s.config.listeners = append(s.config.listeners,
 			listener{addr: DefaultListener})
 	}
 
+	var listenConfig net.ListenConfig
+	if s.config.reusePort {
+		listenConfig.Control = reusePortControl
+	}
+
 	var err error
 	// Start listening for IMAP connections
 	for i, iface := range s.config.listeners {
-		s.config.listeners[i].listener, err = net.Listen("tcp", iface.addr)
+		s.config.listeners[i].tlsConfig = s.config.serverTLSConfig(&iface)
+		iface = s.config.listeners[i]
+
+		s.config.listeners[i].listener, err = listenConfig.Listen(
+			context.Background(), "tcp", iface.addr)
 		if err != nil {
 			log.Printf("IMAP cannot listen on %s, %v", iface.addr, err)
 			return err
 		}
+
+		// Implicit TLS listeners only accept TLS connections
+		if iface.encryption == tlsLevel {
+			s.config.listeners[i].listener = tls.NewListener(
+				s.config.listeners[i].listener, iface.tlsConfig)
+		}
 	}
 
+	return nil
+}
+
+// serve accepts connections on all listeners, returning when the last listener stops
+func (s *Server) serve() {
 	// Start the server on each port
 	n := len(s.config.listeners)
 	for i := 0; i < n; i += 1 {
@@ -167,7 +566,71 @@ func (s *Server) Start() error {
 			s.runListener(listener, i)
 		}
 	}
+}
 
+// isStopping returns true if the server has been asked to stop
+func (s *Server) isStopping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopping
+}
+
+// addClient registers a connected client, returns false if the server is stopping
+func (s *Server) addClient(c *client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		return false
+	}
+	s.clients[c] = struct{}{}
+	return true
+}
+
+// removeClient unregisters a disconnected client
+func (s *Server) removeClient(c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, c)
+}
+
+// newClient creates a client for a connection
+func (s *Server) newClient(conn net.Conn, listener listener, id string) *client {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &client{
+		conn:     conn,
+		listener: listener,
+		bufin:    bufio.NewReader(conn),
+		bufout:   bufio.NewWriter(conn),
+		id:       id,
+		config:   s.config,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// HandleConn serves an IMAP client on a connection accepted by the caller,
+// e.g from a custom listener or a multiplexed stream, and blocks until the
+// client disconnects
+// A *tls.Conn is treated as an implicit TLS connection, other connections
+// as unencrypted
+func (s *Server) HandleConn(conn net.Conn) error {
+	l := listener{addr: conn.LocalAddr().String()}
+	if _, ok := conn.(*tls.Conn); ok {
+		l.encryption = tlsLevel
+	}
+
+	s.mu.Lock()
+	s.handledConns += 1
+	id := fmt.Sprint("conn/", s.handledConns)
+	s.mu.Unlock()
+
+	c := s.newClient(conn, l, id)
+	if !s.addClient(c) {
+		conn.Close()
+		return errors.New("IMAP server is stopping")
+	}
+
+	c.handle(s)
 	return nil
 }
 
@@ -182,19 +645,20 @@ func (s *Server) runListener(listener listener, id int) {
 		// Accept a connection from a new client
 		conn, err := listener.listener.Accept()
 		if err != nil {
+			if s.isStopping() {
+				return
+			}
 			log.Print("IMAP accept error, ", err)
 			continue
 		}
 
 		// Handle the client
-		client := &client{
-			conn:     conn,
-			listener: listener,
-			bufin:    bufio.NewReader(conn),
-			bufout:   bufio.NewWriter(conn),
-			// TODO: perhaps we can do this without Sprint, maybe strconv.Itoa()
-			id:     fmt.Sprint(id, "/", clientNumber),
-			config: s.config,
+		// TODO: perhaps we can do this without Sprint, maybe strconv.Itoa()
+		client := s.newClient(conn, listener, fmt.Sprint(id, "/", clientNumber))
+
+		if !s.addClient(client) {
+			conn.Close()
+			return
 		}
 
 		go client.handle(s)
@@ -204,16 +668,55 @@ func (s *Server) runListener(listener listener, id int) {
 
 }
 
+// claimUser counts a new session for the given user, returns false if the
+// user has too many sessions
+func (s *Server) claimUser(user string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	max := s.config.maxConnectionsPerUser
+	if max > 0 && s.userSessions[user] >= max {
+		return false
+	}
+	s.userSessions[user] += 1
+	return true
+}
+
+// releaseUser stops counting a session for the given user
+func (s *Server) releaseUser(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.userSessions[user] <= 1 {
+		delete(s.userSessions, user)
+	} else {
+		s.userSessions[user] -= 1
+	}
+}
+
 // handle requests from an IMAP client
 func (c *client) handle(s *Server) {
 
 	// Close the client on exit from this function
+	defer s.removeClient(c)
 	defer c.close()
 
 	// Handle parser panics gracefully
 	defer func() {
 		if e := recover(); e != nil {
-			err := e.(parseError)
+			// Do not give internal details of unexpected panics to the client
+			err, isParseError := e.(parseError)
+			if !isParseError {
+				c.logError(fmt.Errorf("panic: %v", e))
+				err = parseError("Internal server error")
+			}
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			// A client being shut down has already been sent a BYE
+			if c.closing {
+				return
+			}
 			c.logError(err)
 			fatalResponse(c.bufout, err)
 		}
@@ -221,9 +724,29 @@ func (c *client) handle(s *Server) {
 
 	// Create a parser
 	parser := createParser(c.bufin)
+	parser.lexer.maxLineLength = c.config.maxLineLength
+
+	// Complete the implicit TLS handshake so that nothing, including the
+	// greeting, is ever sent in cleartext
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(c.ctx, handshakeTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			c.logError(err)
+			return
+		}
+	}
 
 	// Write the welcome message
-	err := ok("*", "IMAP4rev1 Service Ready").write(c.bufout)
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return
+	}
+	err := c.write(ok("*", "IMAP4rev1 Service Ready"))
+	c.greeted = true
+	c.mu.Unlock()
 
 	if err != nil {
 		c.logError(err)
@@ -232,23 +755,18 @@ func (c *client) handle(s *Server) {
 
 	//  Create a session
 	sess := createSession(c.id, c.config, s, &c.listener, c.conn)
+	sess.ctx = c.ctx
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		sess.setTLS(tlsConn)
+	}
+	defer sess.close()
 
 	for {
 		// Get the next IMAP command
 		command := parser.next()
 
-		// Execute the IMAP command
-		response := command.execute(sess)
-
-		// Possibly replace buffers (layering)
-		if response.bufReplacement != nil {
-			c.bufout = response.bufReplacement.W
-			c.bufin = response.bufReplacement.R
-			parser.lexer.reader = &response.bufReplacement.Reader
-		}
-
-		// Write back the response
-		err = response.write(c.bufout)
+		// Execute the IMAP command and write back the response
+		response, err := c.execute(command, sess, parser)
 
 		if err != nil {
 			c.logError(err)
@@ -262,8 +780,165 @@ func (c *client) handle(s *Server) {
 	}
 }
 
+// execute runs a command and writes its response, holding the write lock so
+// that the response is not interleaved with a shutdown
+func (c *client) execute(command command, sess *session, parser *parser) (*response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A client being shut down has been sent a BYE, do not run any more commands
+	if c.closing {
+		return empty().shouldClose(), nil
+	}
+
+	// Execute the IMAP command
+	start := time.Now()
+	var response *response
+	if sess.privacyRequired(command) {
+		response = no(parser.tag, "[PRIVACYREQUIRED] Must issue STARTTLS first")
+	} else {
+		stopHeartbeat := c.startHeartbeat(command)
+		stopWatching := c.watchDisconnect(command, parser)
+		response = command.execute(sess)
+		stopWatching()
+		stopHeartbeat()
+	}
+
+	// Warn about slow commands
+	threshold := c.config.slowCommandThreshold
+	if elapsed := time.Since(start); threshold > 0 && elapsed > threshold {
+		sess.log(fmt.Sprintf("slow command user=%q command=%s tag=%q elapsed=%v",
+			sess.user, parser.commandName, parser.tag, elapsed))
+	}
+
+	// Possibly replace buffers (layering)
+	if response.bufReplacement != nil {
+		c.bufout = response.bufReplacement.W
+		c.bufin = response.bufReplacement.R
+		parser.lexer.reader = &response.bufReplacement.Reader
+	}
+
+	// Write back the response
+	err := c.write(response)
+	sess.audit(parser.commandName, response, time.Since(start))
+	return response, err
+}
+
+// startHeartbeat sends progress responses while a command executes, until
+// the returned function is called
+func (c *client) startHeartbeat(command command) func() {
+	interval := c.config.heartbeatInterval
+
+	// STARTTLS takes over the connection
+	_, isStarttls := command.(*starttls)
+	if interval <= 0 || isStarttls {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				err := c.write(createResponse("*", "OK", "Still processing"))
+				if err != nil {
+					c.logError(err)
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// watchDisconnect cancels the client's context if the connection is closed
+// while a command executes, until the returned function is called
+// The connection is only read from while the command loop is waiting for
+// the command, so the reader is not shared
+func (c *client) watchDisconnect(command command, parser *parser) func() {
+
+	// STARTTLS takes over the connection
+	if _, isStarttls := command.(*starttls); isStarttls {
+		return func() {}
+	}
+
+	reader := parser.lexer.reader.R
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		// Waits for the next command, which is left in the buffer, or for
+		// the connection to close
+		_, err := reader.Peek(1)
+		select {
+		case <-stop:
+		default:
+			if err != nil {
+				c.cancel()
+			}
+		}
+	}()
+
+	return func() {
+		// Interrupt the read
+		close(stop)
+		c.conn.SetReadDeadline(time.Now())
+		<-stopped
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// shutdown sends a BYE to the client, after any response in progress, and
+// closes the connection
+func (c *client) shutdown(message string) {
+	// Ask any command in progress to stop
+	c.cancel()
+
+	// A command may hold the lock while writing to a client that has stopped
+	// reading, bound the time it can block before taking the lock
+	c.conn.SetWriteDeadline(time.Now().Add(shutdownTimeout))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closing = true
+
+	// Writing to a TLS connection before the handshake completes would wait
+	// for the handshake
+	if c.greeted {
+		err := c.write(createResponse("*", "BYE", message))
+		if err != nil {
+			c.logError(err)
+		}
+	}
+	c.conn.Close()
+}
+
+// write sends a response to the client, the write lock must be held
+// Any error leaves the protocol out of step so the connection must be closed
+func (c *client) write(resp *response) error {
+	if c.config.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.config.writeTimeout))
+	}
+
+	return resp.write(c.bufout)
+}
+
 // close closes an IMAP client
 func (c *client) close() {
+	c.cancel()
 	c.conn.Close()
 }
 
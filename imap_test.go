@@ -0,0 +1,1316 @@
+package imapsrv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/alienscience/imapsrv/auth"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTestServer starts a server listening on a random local port
+func startTestServer(t *testing.T, options ...option) (*Server, string) {
+	options = append([]option{ListenOption("127.0.0.1:0"), StoreOption(&TestMailstore{})}, options...)
+	s := NewServer(options...)
+	err := s.ListenAndServe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, s.config.listeners[0].listener.Addr().String()
+}
+
+// dialTestServer connects to a test server and reads the greeting
+func dialTestServer(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	greeting, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		t.Fatalf("Unexpected greeting %q", greeting)
+	}
+	return conn, r
+}
+
+// TestStopSendsBye checks that connected clients are sent a BYE on shutdown
+func TestStopSendsBye(t *testing.T) {
+	s, addr := startTestServer(t)
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	// Make sure the server has handled a command before stopping
+	conn.Write([]byte("a1 NOOP\r\n"))
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "a1 OK") {
+		t.Fatalf("Unexpected NOOP response %q, %v", line, err)
+	}
+
+	s.Stop()
+
+	line, err = r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "* BYE Server shutting down\r\n" {
+		t.Errorf("Expected BYE, got %q", line)
+	}
+
+	_, err = r.ReadString('\n')
+	if err == nil {
+		t.Error("Expected the connection to be closed after BYE")
+	}
+}
+
+// TestListenAndServe checks that the server can be started without blocking
+func TestListenAndServe(t *testing.T) {
+	s, addr := startTestServer(t)
+	defer s.Stop()
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	conn.Write([]byte("a1 NOOP\r\n"))
+	line, err := r.ReadString('\n')
+	if err != nil || line != "a1 OK NOOP Completed\r\n" {
+		t.Errorf("Unexpected NOOP response %q, %v", line, err)
+	}
+}
+
+// TestHealthy checks the health of a running and a stopped server
+func TestHealthy(t *testing.T) {
+	s := NewServer(ListenOption("127.0.0.1:0"), StoreOption(&TestMailstore{}))
+	if s.Healthy() == nil {
+		t.Error("Expected a server that is not listening to be unhealthy")
+	}
+
+	err := s.ListenAndServe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Healthy()
+	if err != nil {
+		t.Errorf("Expected a running server to be healthy, got %v", err)
+	}
+
+	s.Stop()
+	if s.Healthy() == nil {
+		t.Error("Expected a stopped server to be unhealthy")
+	}
+}
+
+// unreachableAuthStore is an authentication backend that cannot be reached
+type unreachableAuthStore struct {
+	*testAuthStore
+}
+
+func (a *unreachableAuthStore) Ping() error {
+	return auth.ErrNotConnected
+}
+
+// TestHealthyAuthBackend checks the authentication backend is probed if it supports it
+func TestHealthyAuthBackend(t *testing.T) {
+	s, _ := startTestServer(t, AuthStoreOption(newTestAuthStore("alice", "s3cret")))
+	defer s.Stop()
+	if err := s.Healthy(); err != nil {
+		t.Errorf("Expected a backend without Ping to be healthy, got %v", err)
+	}
+
+	s, _ = startTestServer(t, AuthStoreOption(&unreachableAuthStore{newTestAuthStore()}))
+	defer s.Stop()
+	if s.Healthy() != auth.ErrNotConnected {
+		t.Error("Expected an unreachable authentication backend to be unhealthy")
+	}
+}
+
+// testCertificate creates a self-signed certificate for the given host names
+func testCertificate(t *testing.T, hosts ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// TestListenTLSConfig checks that a TLS listener can use an in-memory certificate
+func TestListenTLSConfig(t *testing.T) {
+	cert := testCertificate(t, "localhost")
+	s := NewServer(
+		ListenTLSConfigOption("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}}),
+		StoreOption(&TestMailstore{}),
+	)
+	err := s.ListenAndServe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	addr := s.config.listeners[0].listener.Addr().String()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	greeting, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(greeting, "* OK") {
+		t.Fatalf("Unexpected greeting %q, %v", greeting, err)
+	}
+
+	// The certificate served must be the in-memory one
+	peer := conn.ConnectionState().PeerCertificates
+	if len(peer) == 0 || !bytes.Equal(peer[0].Raw, cert.Certificate[0]) {
+		t.Error("Unexpected server certificate")
+	}
+
+	// TLS connections can authenticate
+	conn.Write([]byte("a1 CAPABILITY\r\n"))
+	line, _ := r.ReadString('\n')
+	if line != "* CAPABILITY IMAP4rev1 UNAUTHENTICATE\r\n" {
+		t.Errorf("Unexpected capabilities %q", line)
+	}
+}
+
+// TestTLSNoCleartextGreeting checks a TLS listener does not greet plain
+// TCP clients
+func TestTLSNoCleartextGreeting(t *testing.T) {
+	cert := testCertificate(t, "localhost")
+	s := NewServer(
+		ListenTLSConfigOption("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}}),
+		StoreOption(&TestMailstore{}),
+	)
+	err := s.ListenAndServe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	addr := s.config.listeners[0].listener.Addr().String()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Nothing is sent before the handshake
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	n, _ := conn.Read(buf)
+	if n != 0 {
+		t.Fatalf("Unexpected data before the TLS handshake %q", buf[:n])
+	}
+
+	// A failed handshake drops the connection without a greeting
+	conn.Write([]byte("a1 NOOP\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// The connection can be reset as the server does not read all the input
+	received, _ := io.ReadAll(conn)
+	if bytes.Contains(received, []byte("* OK")) {
+		t.Errorf("Unexpected cleartext greeting %q", received)
+	}
+}
+
+// testAuthStore is an in-memory authentication backend
+type testAuthStore struct {
+	users map[string]string
+}
+
+// newTestAuthStore creates an authentication backend with the given username/password pairs
+func newTestAuthStore(credentials ...string) *testAuthStore {
+	a := &testAuthStore{users: make(map[string]string)}
+	for i := 0; i+1 < len(credentials); i += 2 {
+		a.users[credentials[i]] = credentials[i+1]
+	}
+	return a
+}
+
+func (a *testAuthStore) Authenticate(username, plainPassword string) (bool, error) {
+	password, ok := a.users[username]
+	return ok && password == plainPassword, nil
+}
+
+func (a *testAuthStore) CreateUser(username, plainPassword string) error {
+	a.users[username] = plainPassword
+	return nil
+}
+
+func (a *testAuthStore) ResetPassword(username, plainPassword string) error {
+	a.users[username] = plainPassword
+	return nil
+}
+
+func (a *testAuthStore) ListUsers() ([]string, error) {
+	users := make([]string, 0, len(a.users))
+	for user := range a.users {
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (a *testAuthStore) DeleteUser(username string) error {
+	delete(a.users, username)
+	return nil
+}
+
+// sendCommand sends a command and reads the lines of its response up to the tagged line
+func sendCommand(t *testing.T, conn net.Conn, r *bufio.Reader, tag string, command string) []string {
+	_, err := conn.Write([]byte(tag + " " + command + "\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make([]string, 0, 4)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Reading response to %s, %v", command, err)
+		}
+		lines = append(lines, line)
+		if strings.HasPrefix(line, tag+" ") {
+			return lines
+		}
+	}
+}
+
+// captureLog redirects the default logger until the returned function is called
+func captureLog() (*syncBuffer, func()) {
+	buf := &syncBuffer{}
+	log.SetOutput(buf)
+	return buf, func() { log.SetOutput(os.Stderr) }
+}
+
+// syncBuffer is a bytes.Buffer that can be written by several goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestAuditLog checks that commands are logged without their arguments
+func TestAuditLog(t *testing.T) {
+	s, addr := startTestServer(t, AuthStoreOption(newTestAuthStore("alice", "s3cret")))
+	defer s.Stop()
+
+	logs, restore := captureLog()
+	defer restore()
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, r, "a1", "LOGIN alice s3cret")
+	sendCommand(t, conn, r, "a2", "SELECT inbox")
+
+	output := logs.String()
+	for _, expected := range []string{
+		`user="alice" command=LOGIN tag="a1" result=OK elapsed=`,
+		`user="alice" command=SELECT tag="a2" result=OK elapsed=`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected %q in the audit log:\n%s", expected, output)
+		}
+	}
+
+	if strings.Contains(output, "s3cret") {
+		t.Errorf("The password was logged:\n%s", output)
+	}
+}
+
+// slowMailstore is a dummy mailstore that is slow to find mailboxes
+type slowMailstore struct {
+	TestMailstore
+}
+
+// GetMailbox gets a dummy mailbox after a delay
+func (m *slowMailstore) GetMailbox(path []string) (*Mailbox, error) {
+	time.Sleep(50 * time.Millisecond)
+	return m.TestMailstore.GetMailbox(path)
+}
+
+// TestSlowCommandLog checks slow commands are logged
+func TestSlowCommandLog(t *testing.T) {
+	s, addr := startTestServer(t,
+		StoreOption(&slowMailstore{}),
+		SlowCommandThresholdOption(20*time.Millisecond),
+		AuthStoreOption(newTestAuthStore("alice", "s3cret")))
+	defer s.Stop()
+
+	logs, restore := captureLog()
+	defer restore()
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, r, "a1", "LOGIN alice s3cret")
+	sendCommand(t, conn, r, "a2", "SELECT inbox")
+
+	output := logs.String()
+	if !strings.Contains(output, `slow command user="alice" command=SELECT tag="a2" elapsed=`) {
+		t.Errorf("Expected a slow SELECT in the log:\n%s", output)
+	}
+	if strings.Contains(output, `slow command user="alice" command=LOGIN`) {
+		t.Errorf("LOGIN was logged as slow:\n%s", output)
+	}
+}
+
+// TestHeartbeat checks progress responses are sent during slow commands
+func TestHeartbeat(t *testing.T) {
+	s, addr := startTestServer(t,
+		StoreOption(&slowMailstore{}),
+		HeartbeatIntervalOption(10*time.Millisecond),
+		AuthStoreOption(newTestAuthStore("alice", "s3cret")))
+	defer s.Stop()
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, r, "a1", "LOGIN alice s3cret")
+	resp := sendCommand(t, conn, r, "a2", "SELECT inbox")
+
+	if len(resp) < 2 || resp[0] != "* OK Still processing\r\n" {
+		t.Errorf("Expected a progress response, got %q", resp)
+	}
+	if !strings.HasPrefix(resp[len(resp)-1], "a2 OK SELECT completed") {
+		t.Errorf("Unexpected SELECT response %q", resp)
+	}
+}
+
+// TestLoginNotLogged checks that passwords do not appear in the logs
+func TestLoginNotLogged(t *testing.T) {
+	s, addr := startTestServer(t, AuthStoreOption(newTestAuthStore("alice", "s3cret")))
+	defer s.Stop()
+
+	logs, restore := captureLog()
+	defer restore()
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	resp := sendCommand(t, conn, r, "a1", "LOGIN alice wr0ng")
+	if !strings.HasPrefix(resp[0], "a1 NO") {
+		t.Errorf("Expected LOGIN to fail, got %q", resp)
+	}
+	sendCommand(t, conn, r, "a2", `LOGIN "alice" "s3cret"`)
+
+	output := logs.String()
+	if !strings.Contains(output, "LOGIN failure") {
+		t.Errorf("Expected the failure to be logged:\n%s", output)
+	}
+	for _, password := range []string{"wr0ng", "s3cret"} {
+		if strings.Contains(output, password) {
+			t.Errorf("Password %q was logged:\n%s", password, output)
+		}
+	}
+}
+
+// TestTLSMinVersion checks that old TLS versions are refused
+func TestTLSMinVersion(t *testing.T) {
+	cert := testCertificate(t, "localhost")
+	s := NewServer(
+		ListenTLSConfigOption("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}}),
+		StoreOption(&TestMailstore{}),
+	)
+	err := s.ListenAndServe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	addr := s.config.listeners[0].listener.Addr().String()
+
+	// TLS 1.0 is refused by default
+	_, err = tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS10,
+		MaxVersion:         tls.VersionTLS10,
+	})
+	if err == nil {
+		t.Error("Expected a TLS 1.0 handshake to be refused")
+	}
+
+	// TLS 1.2 is accepted
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatalf("Expected a TLS 1.2 handshake to succeed, %v", err)
+	}
+	conn.Close()
+
+	// The minimum version can be raised
+	s13 := NewServer(
+		ListenTLSConfigOption("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}}),
+		TLSMinVersionOption(tls.VersionTLS13),
+	)
+	err = s13.ListenAndServe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s13.Stop()
+
+	_, err = tls.Dial("tcp", s13.config.listeners[0].listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+	})
+	if err == nil {
+		t.Error("Expected a TLS 1.2 handshake to be refused")
+	}
+}
+
+// TestSNICertificateSelection checks that the certificate is chosen by server name
+func TestSNICertificateSelection(t *testing.T) {
+	certA := testCertificate(t, "mail.a.example")
+	certB := testCertificate(t, "mail.b.example")
+	s := NewServer(
+		ListenTLSConfigOption("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certA, certB}}),
+		StoreOption(&TestMailstore{}),
+	)
+	err := s.ListenAndServe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	addr := s.config.listeners[0].listener.Addr().String()
+
+	for _, test := range []struct {
+		serverName string
+		cert       tls.Certificate
+	}{
+		{"mail.a.example", certA},
+		{"mail.b.example", certB},
+	} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         test.serverName,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		peer := conn.ConnectionState().PeerCertificates
+		if len(peer) == 0 || !bytes.Equal(peer[0].Raw, test.cert.Certificate[0]) {
+			t.Errorf("Unexpected certificate for %s", test.serverName)
+		}
+		conn.Close()
+	}
+}
+
+// startSTARTTLSTestServer starts a server with a STARTTLS listener on a random local port
+func startSTARTTLSTestServer(t *testing.T, options ...option) (*Server, string) {
+	cert := testCertificate(t, "localhost")
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	options = append([]option{
+		ListenSTARTTLSConfigOption("127.0.0.1:0", tlsConfig),
+		StoreOption(&TestMailstore{}),
+	}, options...)
+
+	s := NewServer(options...)
+	err := s.ListenAndServe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, s.config.listeners[0].listener.Addr().String()
+}
+
+// TestSTARTTLS checks that commands work after a STARTTLS negotiation
+func TestSTARTTLS(t *testing.T) {
+	s, addr := startSTARTTLSTestServer(t)
+	defer s.Stop()
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	resp := sendCommand(t, conn, r, "a1", "STARTTLS")
+	if resp[0] != "a1 OK Begin TLS negotiation now\r\n" {
+		t.Fatalf("Unexpected STARTTLS response %q", resp)
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	tr := bufio.NewReader(tlsConn)
+	resp = sendCommand(t, tlsConn, tr, "a2", "CAPABILITY")
+	if resp[0] != "* CAPABILITY IMAP4rev1 UNAUTHENTICATE\r\n" || resp[1] != "a2 OK CAPABILITY completed\r\n" {
+		t.Errorf("Unexpected CAPABILITY response %q", resp)
+	}
+
+	// STARTTLS cannot be repeated
+	resp = sendCommand(t, tlsConn, tr, "a3", "STARTTLS")
+	if !strings.HasPrefix(resp[0], "a3 BAD") {
+		t.Errorf("Unexpected STARTTLS response %q", resp)
+	}
+}
+
+// TestSTARTTLSAuditLog checks the negotiated TLS version is logged
+func TestSTARTTLSAuditLog(t *testing.T) {
+	s, addr := startSTARTTLSTestServer(t)
+	defer s.Stop()
+
+	logs, restore := captureLog()
+	defer restore()
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, r, "a1", "STARTTLS")
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+	})
+	tr := bufio.NewReader(tlsConn)
+	sendCommand(t, tlsConn, tr, "a2", "NOOP")
+
+	// The audit log is written after the response
+	sendCommand(t, tlsConn, tr, "a3", "NOOP")
+
+	output := logs.String()
+	if !strings.Contains(output, `command=NOOP tag="a2" result=OK`) ||
+		!strings.Contains(output, `tls="TLS 1.2" cipher=TLS_`) {
+		t.Errorf("Expected the TLS version in the audit log:\n%s", output)
+	}
+}
+
+// TestFailedSTARTTLS checks that a failed negotiation does not fall back to cleartext
+func TestFailedSTARTTLS(t *testing.T) {
+	s, addr := startSTARTTLSTestServer(t)
+	defer s.Stop()
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	resp := sendCommand(t, conn, r, "a1", "STARTTLS")
+	if !strings.HasPrefix(resp[0], "a1 OK") {
+		t.Fatalf("Unexpected STARTTLS response %q", resp)
+	}
+
+	// Carry on in cleartext instead of negotiating TLS
+	conn.Write([]byte("a2 LOGIN alice s3cret\r\n"))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var output bytes.Buffer
+	_, err := output.ReadFrom(r)
+	if err != nil {
+		t.Fatalf("Expected the connection to be closed, %v", err)
+	}
+	if strings.Contains(output.String(), "a2 ") {
+		t.Errorf("Unexpected cleartext response %q", output.String())
+	}
+}
+
+// TestStopDuringSTARTTLS checks Stop does not wait for a client that stalls
+// after STARTTLS
+func TestStopDuringSTARTTLS(t *testing.T) {
+	s, addr := startSTARTTLSTestServer(t)
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, r, "a1", "STARTTLS")
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Stop to return during a STARTTLS handshake")
+	}
+}
+
+// TestRequireTLS checks that commands are refused before STARTTLS
+func TestRequireTLS(t *testing.T) {
+	s, addr := startSTARTTLSTestServer(t,
+		RequireTLSOption(),
+		AuthStoreOption(newTestAuthStore("alice", "s3cret")))
+	defer s.Stop()
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	resp := sendCommand(t, conn, r, "a1", `LIST "" *`)
+	if resp[0] != "a1 NO [PRIVACYREQUIRED] Must issue STARTTLS first\r\n" {
+		t.Errorf("Unexpected LIST response %q", resp)
+	}
+
+	resp = sendCommand(t, conn, r, "a2", "NOOP")
+	if !strings.HasPrefix(resp[0], "a2 OK") {
+		t.Errorf("Unexpected NOOP response %q", resp)
+	}
+
+	resp = sendCommand(t, conn, r, "b1", "FROBNICATE")
+	if !strings.HasPrefix(resp[0], "b1 BAD") {
+		t.Errorf("Unexpected response to an unknown command %q", resp)
+	}
+
+	resp = sendCommand(t, conn, r, "b2", "LOGIN alice")
+	if !strings.HasPrefix(resp[0], "b2 BAD") {
+		t.Errorf("Unexpected response to a malformed command %q", resp)
+	}
+
+	sendCommand(t, conn, r, "a3", "STARTTLS")
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	tr := bufio.NewReader(tlsConn)
+
+	resp = sendCommand(t, tlsConn, tr, "a4", "LOGIN alice s3cret")
+	if !strings.HasPrefix(resp[0], "a4 OK") {
+		t.Errorf("Unexpected LOGIN response %q", resp)
+	}
+}
+
+// writeCertificateFiles writes a certificate and its key to temporary PEM files
+func writeCertificateFiles(t *testing.T, cert tls.Certificate) (string, string) {
+	dir := t.TempDir()
+	certFile := dir + "/cert.pem"
+	keyFile := dir + "/key.pem"
+
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})
+	if os.WriteFile(certFile, certPem, 0600) != nil || os.WriteFile(keyFile, keyPem, 0600) != nil {
+		t.Fatal("Cannot write certificate files")
+	}
+
+	return certFile, keyFile
+}
+
+// TestReloadTLS checks that reloaded certificates are used for new connections only
+func TestReloadTLS(t *testing.T) {
+	oldCert := testCertificate(t, "localhost")
+	newCert := testCertificate(t, "localhost")
+	certFile, keyFile := writeCertificateFiles(t, newCert)
+
+	s := NewServer(
+		ListenTLSConfigOption("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{oldCert}}),
+		StoreOption(&TestMailstore{}),
+	)
+	err := s.ListenAndServe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	addr := s.config.listeners[0].listener.Addr().String()
+
+	// dial connects and returns the certificate served
+	dial := func() (*tls.Conn, *bufio.Reader, []byte) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(conn)
+		r.ReadString('\n')
+		return conn, r, conn.ConnectionState().PeerCertificates[0].Raw
+	}
+
+	existing, existingReader, served := dial()
+	defer existing.Close()
+	if !bytes.Equal(served, oldCert.Certificate[0]) {
+		t.Error("Expected the original certificate before reloading")
+	}
+
+	err = s.ReloadTLS("127.0.0.1:0", certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _, served := dial()
+	conn.Close()
+	if !bytes.Equal(served, newCert.Certificate[0]) {
+		t.Error("Expected the reloaded certificate for a new connection")
+	}
+
+	// The existing connection carries on
+	resp := sendCommand(t, existing, existingReader, "a1", "NOOP")
+	if !strings.HasPrefix(resp[0], "a1 OK") {
+		t.Errorf("Unexpected NOOP response %q", resp)
+	}
+
+	if s.ReloadTLS("127.0.0.1:1", certFile, keyFile) == nil {
+		t.Error("Expected an error reloading an unknown listener")
+	}
+}
+
+// TestCommandBeforeGreeting checks that a command sent before the greeting is read is answered
+func TestCommandBeforeGreeting(t *testing.T) {
+	s, addr := startTestServer(t)
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Send a command straight away
+	_, err = conn.Write([]byte("a1 CAPABILITY\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	expected := []string{
+		"* OK IMAP4rev1 Service Ready\r\n",
+		"* CAPABILITY IMAP4rev1",
+		"a1 OK CAPABILITY completed\r\n",
+	}
+	for _, prefix := range expected {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, prefix) {
+			t.Errorf("Expected %q, got %q", prefix, line)
+		}
+	}
+}
+
+// TestAllowPlainAuth checks LOGIN before STARTTLS on listeners with different settings
+func TestAllowPlainAuth(t *testing.T) {
+	cert := testCertificate(t, "localhost")
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	s := NewServer(
+		ListenSTARTTLSConfigOption("127.0.0.1:0", tlsConfig),
+		ListenSTARTTLSConfigOption("localhost:0", tlsConfig),
+		AllowPlainAuthOption("localhost:0"),
+		AuthStoreOption(newTestAuthStore("alice", "s3cret")),
+		StoreOption(&TestMailstore{}),
+	)
+	err := s.ListenAndServe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	tests := []struct {
+		addr       string
+		capability string
+		login      string
+	}{
+		{s.config.listeners[0].listener.Addr().String(),
+			"* CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED UNAUTHENTICATE\r\n", "a2 NO"},
+		{s.config.listeners[1].listener.Addr().String(),
+			"* CAPABILITY IMAP4rev1 STARTTLS UNAUTHENTICATE\r\n", "a2 OK"},
+	}
+
+	for _, test := range tests {
+		conn, r := dialTestServer(t, test.addr)
+
+		resp := sendCommand(t, conn, r, "a1", "CAPABILITY")
+		if resp[0] != test.capability {
+			t.Errorf("Unexpected capabilities %q on %s", resp[0], test.addr)
+		}
+
+		resp = sendCommand(t, conn, r, "a2", "LOGIN alice s3cret")
+		if !strings.HasPrefix(resp[0], test.login) {
+			t.Errorf("Unexpected LOGIN response %q on %s", resp[0], test.addr)
+		}
+
+		conn.Close()
+	}
+}
+
+// TestAllowPlainAuthRequireTLS checks RequireTLS does not apply to listeners allowing plain auth
+func TestAllowPlainAuthRequireTLS(t *testing.T) {
+	cert := testCertificate(t, "localhost")
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	s := NewServer(
+		ListenSTARTTLSConfigOption("127.0.0.1:0", tlsConfig),
+		ListenSTARTTLSConfigOption("localhost:0", tlsConfig),
+		AllowPlainAuthOption("localhost:0"),
+		RequireTLSOption(),
+		AuthStoreOption(newTestAuthStore("alice", "s3cret")),
+		StoreOption(&TestMailstore{}),
+	)
+	err := s.ListenAndServe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	tests := []struct {
+		addr  string
+		login string
+		list  string
+	}{
+		{s.config.listeners[0].listener.Addr().String(),
+			"a1 NO [PRIVACYREQUIRED]", "a2 NO [PRIVACYREQUIRED]"},
+		{s.config.listeners[1].listener.Addr().String(),
+			"a1 OK", "a2 OK"},
+	}
+
+	for _, test := range tests {
+		conn, r := dialTestServer(t, test.addr)
+
+		resp := sendCommand(t, conn, r, "a1", "LOGIN alice s3cret")
+		if !strings.HasPrefix(resp[0], test.login) {
+			t.Errorf("Unexpected LOGIN response %q on %s", resp[0], test.addr)
+		}
+
+		resp = sendCommand(t, conn, r, "a2", `LIST "" *`)
+		if !strings.HasPrefix(resp[len(resp)-1], test.list) {
+			t.Errorf("Unexpected LIST response %q on %s", resp, test.addr)
+		}
+
+		conn.Close()
+	}
+}
+
+// TestMaxConnectionsPerUser checks the limit on sessions of a single user
+func TestMaxConnectionsPerUser(t *testing.T) {
+	s, addr := startTestServer(t,
+		MaxConnectionsPerUserOption(2),
+		AuthStoreOption(newTestAuthStore("alice", "s3cret", "bob", "hunter2")))
+	defer s.Stop()
+
+	// login connects and logs in, returning the tagged response
+	login := func(user, password string) (net.Conn, string) {
+		conn, r := dialTestServer(t, addr)
+		resp := sendCommand(t, conn, r, "a1", "LOGIN "+user+" "+password)
+		return conn, resp[len(resp)-1]
+	}
+
+	first, resp := login("alice", "s3cret")
+	if !strings.HasPrefix(resp, "a1 OK") {
+		t.Fatalf("Unexpected LOGIN response %q", resp)
+	}
+	second, resp := login("alice", "s3cret")
+	if !strings.HasPrefix(resp, "a1 OK") {
+		t.Fatalf("Unexpected LOGIN response %q", resp)
+	}
+
+	third, resp := login("alice", "s3cret")
+	defer third.Close()
+	if resp != "a1 NO [LIMIT] LOGIN too many connections for this user\r\n" {
+		t.Errorf("Expected the third session to be refused, got %q", resp)
+	}
+
+	// Other users are not affected
+	other, resp := login("bob", "hunter2")
+	defer other.Close()
+	if !strings.HasPrefix(resp, "a1 OK") {
+		t.Errorf("Unexpected LOGIN response %q", resp)
+	}
+
+	// Closing a session frees a slot
+	first.Close()
+	second.Close()
+	for i := 0; i < 100; i++ {
+		conn, resp := login("alice", "s3cret")
+		conn.Close()
+		if strings.HasPrefix(resp, "a1 OK") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected a slot to be freed after disconnecting")
+}
+
+// TestUnauthenticate checks a connection can be reused by another user
+func TestUnauthenticate(t *testing.T) {
+	s, addr := startTestServer(t,
+		MaxConnectionsPerUserOption(1),
+		AuthStoreOption(newTestAuthStore("alice", "s3cret", "bob", "hunter2")))
+	defer s.Stop()
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	resp := sendCommand(t, conn, r, "a1", "UNAUTHENTICATE")
+	if resp[0] != "a1 BAD UNAUTHENTICATE not authenticated\r\n" {
+		t.Errorf("Unexpected UNAUTHENTICATE response %q", resp)
+	}
+
+	resp = sendCommand(t, conn, r, "a2", "LOGIN alice s3cret")
+	if !strings.HasPrefix(resp[0], "a2 OK") {
+		t.Fatalf("Unexpected LOGIN response %q", resp)
+	}
+	resp = sendCommand(t, conn, r, "a3", "SELECT inbox")
+	if !strings.HasPrefix(resp[len(resp)-1], "a3 OK") {
+		t.Fatalf("Unexpected SELECT response %q", resp)
+	}
+
+	resp = sendCommand(t, conn, r, "a4", "UNAUTHENTICATE")
+	if resp[0] != "a4 OK UNAUTHENTICATE completed\r\n" {
+		t.Fatalf("Unexpected UNAUTHENTICATE response %q", resp)
+	}
+
+	// The previous user's state must be gone
+	resp = sendCommand(t, conn, r, "a5", "SELECT inbox")
+	if !strings.HasPrefix(resp[len(resp)-1], "a5 BAD") {
+		t.Errorf("Expected SELECT to fail after UNAUTHENTICATE, got %q", resp)
+	}
+	s.mu.Lock()
+	sessions := s.userSessions["alice"]
+	s.mu.Unlock()
+	if sessions != 0 {
+		t.Errorf("Expected alice's connection slot to be released, got %d", sessions)
+	}
+
+	resp = sendCommand(t, conn, r, "a6", "LOGIN bob hunter2")
+	if !strings.HasPrefix(resp[0], "a6 OK") {
+		t.Fatalf("Unexpected LOGIN response %q", resp)
+	}
+
+	// The first user can log in elsewhere
+	other, or := dialTestServer(t, addr)
+	defer other.Close()
+	resp = sendCommand(t, other, or, "b1", "LOGIN alice s3cret")
+	if !strings.HasPrefix(resp[0], "b1 OK") {
+		t.Errorf("Unexpected LOGIN response %q", resp)
+	}
+}
+
+// largeMailstore is a dummy mailstore with a large number of mailboxes
+type largeMailstore struct {
+	TestMailstore
+}
+
+// GetMailboxes returns many mailboxes with long names at the root
+func (m *largeMailstore) GetMailboxes(path []string) ([]*Mailbox, error) {
+	if len(path) != 0 {
+		return []*Mailbox{}, nil
+	}
+
+	mboxes := make([]*Mailbox, 100000)
+	for i := range mboxes {
+		name := fmt.Sprintf("%06d-%s", i, strings.Repeat("x", 500))
+		mboxes[i] = &Mailbox{Name: name, Path: []string{name}, Id: int64(i)}
+	}
+	return mboxes, nil
+}
+
+// deepMailstore is a dummy mailstore that is slow to list mailboxes
+type deepMailstore struct {
+	TestMailstore
+}
+
+// GetMailboxes returns many mailboxes at the root, after a delay
+func (m *deepMailstore) GetMailboxes(path []string) ([]*Mailbox, error) {
+	time.Sleep(10 * time.Millisecond)
+	if len(path) != 0 {
+		return []*Mailbox{}, nil
+	}
+
+	mboxes := make([]*Mailbox, 1000)
+	for i := range mboxes {
+		name := fmt.Sprintf("%04d", i)
+		mboxes[i] = &Mailbox{Name: name, Path: []string{name}, Id: int64(i)}
+	}
+	return mboxes, nil
+}
+
+// TestStopCancelsCommand checks a long command stops when the server stops
+func TestStopCancelsCommand(t *testing.T) {
+	s, addr := startTestServer(t,
+		StoreOption(&deepMailstore{}),
+		AuthStoreOption(newTestAuthStore("alice", "s3cret")))
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, r, "a1", "LOGIN alice s3cret")
+
+	// Listing everything takes at least 10 seconds
+	conn.Write([]byte("a2 LIST \"\" *\r\n"))
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	s.Stop()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Stop took %v, the LIST was not cancelled", elapsed)
+	}
+}
+
+// TestDisconnectCancelsCommand checks a long command stops when its client disconnects
+func TestDisconnectCancelsCommand(t *testing.T) {
+	s, addr := startTestServer(t,
+		StoreOption(&deepMailstore{}),
+		AuthStoreOption(newTestAuthStore("alice", "s3cret")))
+	defer s.Stop()
+
+	conn, r := dialTestServer(t, addr)
+	sendCommand(t, conn, r, "a1", "LOGIN alice s3cret")
+
+	// Listing everything takes at least 10 seconds
+	conn.Write([]byte("a2 LIST \"\" *\r\n"))
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+
+	for i := 0; i < 200; i++ {
+		s.mu.Lock()
+		connected := len(s.clients)
+		s.mu.Unlock()
+
+		if connected == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected the LIST to stop when the client disconnected")
+}
+
+// TestWriteTimeout checks that a client that stops reading is disconnected
+func TestWriteTimeout(t *testing.T) {
+	s, addr := startTestServer(t,
+		WriteTimeoutOption(100*time.Millisecond),
+		StoreOption(&largeMailstore{}),
+		AuthStoreOption(newTestAuthStore("alice", "s3cret")))
+	defer s.Stop()
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, r, "a1", "LOGIN alice s3cret")
+
+	// Ask for a large response and stop reading
+	conn.Write([]byte("a2 LIST \"\" %\r\n"))
+
+	for i := 0; i < 500; i++ {
+		s.mu.Lock()
+		connected := len(s.clients)
+		s.mu.Unlock()
+
+		if connected == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected the slow client to be disconnected")
+}
+
+// TestStopBlockedClient checks Stop does not hang on a client that has stopped reading
+func TestStopBlockedClient(t *testing.T) {
+	s, addr := startTestServer(t,
+		StoreOption(&largeMailstore{}),
+		AuthStoreOption(newTestAuthStore("alice", "s3cret")))
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, r, "a1", "LOGIN alice s3cret")
+
+	// Ask for a large response and stop reading
+	conn.Write([]byte("a2 LIST \"\" %\r\n"))
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Stop to return while the client is not reading")
+	}
+}
+
+// TestStopDuringHandshake checks Stop does not wait for a client that never
+// starts its TLS handshake
+func TestStopDuringHandshake(t *testing.T) {
+	cert := testCertificate(t, "localhost")
+	s := NewServer(
+		ListenTLSConfigOption("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}}),
+		StoreOption(&TestMailstore{}),
+	)
+	err := s.ListenAndServe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", s.config.listeners[0].listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Stop to return during a TLS handshake")
+	}
+}
+
+// TestExecuteAfterShutdown checks a command parsed before a shutdown is not run
+func TestExecuteAfterShutdown(t *testing.T) {
+	s := NewServer(StoreOption(&TestMailstore{}), AuthStoreOption(newTestAuthStore("alice", "s3cret")))
+	c := &client{config: s.config, closing: true}
+	sess := createSession("1", s.config, s, &c.listener, nil)
+
+	resp, err := c.execute(&login{tag: "a1", userId: "alice", password: "s3cret"}, sess, nil)
+	if err != nil || !resp.closeConnection || sess.st != notAuthenticated {
+		t.Errorf("Unexpected LOGIN after shutdown %v, %v", resp, err)
+	}
+}
+
+// TestMaxLineLength checks over long command lines are rejected
+func TestMaxLineLength(t *testing.T) {
+	s, addr := startTestServer(t, MaxLineLengthOption(1024))
+	defer s.Stop()
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	resp := sendCommand(t, conn, r, "a1", "NOOP")
+	if resp[0] != "a1 OK NOOP Completed\r\n" {
+		t.Fatalf("Unexpected NOOP response %q", resp)
+	}
+
+	// Send a line that never ends
+	go conn.Write([]byte("a2 " + strings.Repeat("x", 64*1024)))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "* BYE Command line too long\r\n" {
+		t.Errorf("Unexpected response %q", line)
+	}
+}
+
+// TestMalformedCommandResponse checks a malformed command gets a tagged BAD
+// and the connection carries on
+func TestMalformedCommandResponse(t *testing.T) {
+	s, addr := startTestServer(t)
+	defer s.Stop()
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	resp := sendCommand(t, conn, r, "a1", "SELECT")
+	if !strings.HasPrefix(resp[0], "a1 BAD ") {
+		t.Errorf("Unexpected SELECT response %q", resp)
+	}
+
+	resp = sendCommand(t, conn, r, "a2", "NOOP")
+	if resp[0] != "a2 OK NOOP Completed\r\n" {
+		t.Errorf("Unexpected NOOP response %q", resp)
+	}
+}
+
+// TestUnknownCommandLiteral checks an unknown command with a literal
+// argument does not desynchronise the connection
+func TestUnknownCommandLiteral(t *testing.T) {
+	s, addr := startTestServer(t)
+	defer s.Stop()
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	resp := sendCommand(t, conn, r, "a1", "XUNKNOWN {5}\r\nABCDE")
+	if resp[0] != "a1 BAD XUNKNOWN unknown command\r\n" {
+		t.Errorf("Unexpected response %q", resp)
+	}
+
+	resp = sendCommand(t, conn, r, "a2", "NOOP")
+	if resp[0] != "a2 OK NOOP Completed\r\n" {
+		t.Errorf("Unexpected NOOP response %q", resp)
+	}
+}
+
+// TestPipelinedCommands checks commands sent together are answered in order
+func TestPipelinedCommands(t *testing.T) {
+	s, addr := startTestServer(t)
+	defer s.Stop()
+
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	conn.Write([]byte("a NOOP\r\nb CAPABILITY\r\nc LOGOUT\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "a OK NOOP Completed\r\n" +
+		"* CAPABILITY IMAP4rev1 UNAUTHENTICATE\r\n" +
+		"b OK CAPABILITY completed\r\n" +
+		"* BYE IMAP4rev1 Server logging out\r\n" +
+		"c OK LOGOUT completed\r\n"
+	if string(received) != expected {
+		t.Errorf("Unexpected responses %q", received)
+	}
+}
+
+// TestHandleConn checks a server can serve a connection accepted elsewhere
+func TestHandleConn(t *testing.T) {
+	s := NewServer(StoreOption(&TestMailstore{}))
+	defer s.Stop()
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	done := make(chan error)
+	go func() {
+		done <- s.HandleConn(serverConn)
+	}()
+
+	r := bufio.NewReader(clientConn)
+	greeting, err := r.ReadString('\n')
+	if err != nil || greeting != "* OK IMAP4rev1 Service Ready\r\n" {
+		t.Fatalf("Unexpected greeting %q, %v", greeting, err)
+	}
+
+	resp := sendCommand(t, clientConn, r, "a1", "CAPABILITY")
+	if resp[0] != "* CAPABILITY IMAP4rev1 UNAUTHENTICATE\r\n" ||
+		resp[1] != "a1 OK CAPABILITY completed\r\n" {
+		t.Errorf("Unexpected CAPABILITY response %q", resp)
+	}
+
+	sendCommand(t, clientConn, r, "a2", "LOGOUT")
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
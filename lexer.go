@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"net/textproto"
 	"strconv"
 )
@@ -18,6 +19,11 @@ type lexer struct {
 	idx int
 	// The start of tokens, used for rewinding to the previous token
 	tokens []int
+	// The maximum length of a line, not counting literals, 0 is unlimited
+	maxLineLength int
+	// failed is set if a line could not be read, the input is then out of
+	// step with the commands and lexing cannot continue
+	failed bool
 }
 
 // Ascii codes
@@ -105,6 +111,24 @@ func (l *lexer) listMailbox() (bool, string) {
 	return l.generalString("LIST-MAILBOX", listMailboxExceptionsChar)
 }
 
+// skipLine skips the remainder of the command, including any literals, so
+// that lexing can continue with the next command
+func (l *lexer) skipLine() {
+	for {
+		length, ok := literalLength(l.line)
+		l.idx = len(l.line)
+		if !ok {
+			return
+		}
+
+		_, err := io.CopyN(io.Discard, l.reader.R, length)
+		if err != nil {
+			panic(parseError(err.Error()))
+		}
+		l.newLine()
+	}
+}
+
 //-------- IMAP token helper functions -----------------------------------------
 
 // generalString handles a string that can be bare, a literal or quoted
@@ -156,6 +180,7 @@ func (l *lexer) qstring() string {
 }
 
 // literal parses a length tagged literal
+// The literal is read as raw bytes so that it can contain line endings
 // TODO: send a continuation request after the first line is read
 func (l *lexer) literal() string {
 
@@ -181,31 +206,51 @@ func (l *lexer) literal() string {
 		panic(parseError(err.Error()))
 	}
 
-	// Consider the next line
+	// The literal must be the last thing on the line
+	if l.idx != len(l.line)-1 {
+		panic(parseError("Unexpected characters after literal length"))
+	}
+
+	// Read the literal
+	buffer := l.readLiteral(length)
+
+	// The command continues on the line following the literal
 	l.newLine()
 
-	// Does the literal have a valid length?
-	if length <= 0 {
-		return ""
+	return string(buffer)
+}
+
+// readLiteral reads the data of a literal with the given length
+// The buffer grows as the data arrives, so a client cannot make the server
+// allocate memory just by sending a large literal length
+func (l *lexer) readLiteral(length int64) []byte {
+	var buffer bytes.Buffer
+	_, err := io.CopyN(&buffer, l.reader.R, length)
+	if err != nil {
+		panic(parseError(err.Error()))
 	}
 
-	// Read the literal
-	buffer := make([]byte, 0, length)
-	c = l.current()
+	return buffer.Bytes()
+}
 
-	for {
-		buffer = append(buffer, c)
+// literalLength returns the length of the literal at the end of a line, if any
+func literalLength(line []byte) (int64, bool) {
 
-		// Is this the end of the literal?
-		length -= 1
-		if length == 0 {
-			break
-		}
+	if len(line) == 0 || line[len(line)-1] != rightCurly {
+		return 0, false
+	}
 
-		c = l.consumeAll()
+	start := bytes.LastIndexByte(line, leftCurly)
+	if start == -1 {
+		return 0, false
 	}
 
-	return string(buffer)
+	length, err := strconv.ParseInt(string(line[start+1:len(line)-1]), 10, 32)
+	if err != nil || length < 0 {
+		return 0, false
+	}
+
+	return length, true
 }
 
 // nonquoted reads a non-quoted string
@@ -236,52 +281,84 @@ func (l *lexer) nonquoted(name string, exceptions []byte) (bool, string) {
 // Does not go through newlines
 func (l *lexer) consume() byte {
 
-	// Is there any line left?
-	if l.idx >= len(l.line)-1 {
-		// Return linefeed
-		return lf
+	// Move to the next byte, at the end of the line current() returns linefeed
+	if l.idx < len(l.line) {
+		l.idx += 1
 	}
 
-	// Move to the next byte
-	l.idx += 1
 	return l.current()
 }
 
-// consumeAll a single byte and return the new character
-// Goes through newlines
-func (l *lexer) consumeAll() byte {
+// current gets the current byte
+func (l *lexer) current() byte {
 
-	// Is there any line left?
-	if l.idx >= len(l.line)-1 {
-		l.newLine()
-		return l.current()
+	// Is this an empty line?
+	if l.idx >= len(l.line) {
+		return lf
 	}
 
-	// Move to the next byte
-	l.idx += 1
-	return l.current()
-}
-
-// current gets the current byte
-func (l *lexer) current() byte {
 	return l.line[l.idx]
 }
 
 // newLine moves onto a new line
+// IMAP lines end in CRLF but, to make testing with telnet easier, a bare LF
+// is also accepted as a line ending. A CR that is not part of a line ending
+// is rejected.
 func (l *lexer) newLine() {
 
+	// Forget the previous line, any literal at its end has been consumed
+	l.line = nil
+	l.idx = 0
+
 	// Read the line
-	line, err := l.reader.ReadLineBytes()
+	line, err := l.readLine()
 	if err != nil {
+		l.failed = true
 		panic(parseError(err.Error()))
 	}
 
+	// Reject bare carriage returns
+	if bytes.IndexByte(line, cr) != -1 {
+		l.failed = true
+		panic(parseError("Unexpected CR without LF"))
+	}
+
 	// Reset the lexer - we cannot rewind past line boundaries
 	l.line = line
 	l.idx = 0
 	l.tokens = make([]int, 0, 8)
 }
 
+// readLine reads a line, without the line ending, that is no longer than the
+// maximum line length
+func (l *lexer) readLine() ([]byte, error) {
+	if l.maxLineLength <= 0 {
+		return l.reader.ReadLineBytes()
+	}
+
+	// Read in chunks so that an over long line is not held in memory
+	var line []byte
+	for {
+		chunk, err := l.reader.R.ReadSlice(lf)
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		line = append(line, chunk...)
+
+		if len(bytes.TrimRight(line, "\r\n")) > l.maxLineLength {
+			return nil, parseError("Command line too long")
+		}
+		if err == nil {
+			break
+		}
+	}
+
+	// Remove the line ending
+	line = bytes.TrimSuffix(line, []byte{lf})
+	line = bytes.TrimSuffix(line, []byte{cr})
+	return line, nil
+}
+
 // skipSpace skips any spaces
 func (l *lexer) skipSpace() {
 	c := l.current()
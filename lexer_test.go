@@ -205,3 +205,71 @@ func TestLexesLiteral(t *testing.T) {
 	}
 
 }
+
+func TestMixedLineEndings(t *testing.T) {
+
+	// Bare LF and CRLF line endings in the same session
+	r := bufio.NewReader(strings.NewReader(
+		"a1 NOOP\na2 SELECT {6}\r\nIN\r\nBX\na3 LOGIN user pass\r\n"))
+	p := createParser(r)
+
+	if _, ok := p.next().(*noop); !ok {
+		t.Error("Expected a NOOP command")
+	}
+
+	// The literal contains a CRLF and is followed by a bare LF
+	sel, ok := p.next().(*selectMailbox)
+	if !ok || sel.mailbox != "IN\r\nBX" {
+		t.Errorf("Unexpected SELECT command %#v", sel)
+	}
+
+	cmd, ok := p.next().(*login)
+	if !ok || cmd.userId != "user" || cmd.password != "pass" {
+		t.Errorf("Unexpected LOGIN command %#v", cmd)
+	}
+}
+
+func TestBareCarriageReturn(t *testing.T) {
+
+	r := bufio.NewReader(strings.NewReader("a1 NOOP\rX\r\n"))
+	l := createLexer(r)
+
+	defer func() {
+		if _, ok := recover().(parseError); !ok {
+			t.Error("Expected a parse error for a bare CR")
+		}
+	}()
+
+	l.newLine()
+}
+
+func TestLexerMaxLineLength(t *testing.T) {
+
+	long := strings.Repeat("x", 100)
+	r := bufio.NewReaderSize(strings.NewReader(
+		"a1 NOOP\r\na2 LOGIN {3}\r\nbob "+long[:10]+"\r\na3 "+long+"\r\n"), 16)
+	l := createLexer(r)
+	l.maxLineLength = 20
+
+	// Short lines and literals are accepted
+	l.newLine()
+	if string(l.line) != "a1 NOOP" {
+		t.Errorf("Unexpected line %q", l.line)
+	}
+	l.newLine()
+	l.tag()
+	l.astring()
+	_, user := l.astring()
+	if user != "bob" {
+		t.Errorf("Unexpected literal %q", user)
+	}
+
+	// Long lines are rejected
+	defer func() {
+		e := recover()
+		if e == nil || e.(parseError).Error() != "Command line too long" {
+			t.Errorf("Expected a long line to be rejected, got %v", e)
+		}
+	}()
+	l.newLine()
+}
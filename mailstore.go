@@ -32,6 +32,11 @@ const (
 	Unmarked
 )
 
+// Selectable indicates whether the mailbox can be selected
+func (m *Mailbox) Selectable() bool {
+	return m.Flags&Noselect == 0
+}
+
 var mailboxFlags = map[uint8]string{
 	Noinferiors: "Noinferiors",
 	Noselect:    "Noselect",
@@ -47,15 +52,70 @@ type Mailstore interface {
 	// GetMailboxes gets a list of mailboxes at the given path
 	GetMailboxes(path []string) ([]*Mailbox, error)
 	// FirstUnseen gets the sequence number of the first unseen message in an IMAP mailbox
+	// Returns 0, or a negative number, if there are no unseen messages
 	FirstUnseen(mbox int64) (int64, error)
 	// TotalMessages gets the total number of messages in an IMAP mailbox
 	TotalMessages(mbox int64) (int64, error)
 	// RecentMessages gets the total number of unread messages in an IMAP mailbox
 	RecentMessages(mbox int64) (int64, error)
 	// NextUid gets the next available uid in an IMAP mailbox
+	// This is used to report UIDNEXT, so it must not allocate the uid: calling
+	// it repeatedly returns the same value until a message is added
 	NextUid(mbox int64) (int64, error)
 }
 
+// MailboxStatus holds the counters reported when a mailbox is selected
+type MailboxStatus struct {
+	FirstUnseen    int64 // Sequence number of the first unseen message, 0 if none
+	TotalMessages  int64 // Number of messages
+	RecentMessages int64 // Number of recent messages
+	NextUid        int64 // The next available uid, which is not allocated
+}
+
+// StatusMailstore is implemented by mailstores that can read all of the
+// mailbox counters in a single operation
+type StatusMailstore interface {
+	// MailboxStatus gets the counters of an IMAP mailbox
+	MailboxStatus(mbox int64) (*MailboxStatus, error)
+}
+
+// mailboxStatus gets the counters of an IMAP mailbox, in a single call if
+// the mailstore supports it
+func mailboxStatus(m Mailstore, mbox int64) (*MailboxStatus, error) {
+	if statusStore, ok := m.(StatusMailstore); ok {
+		return statusStore.MailboxStatus(mbox)
+	}
+
+	var err error
+	status := &MailboxStatus{}
+
+	status.FirstUnseen, err = m.FirstUnseen(mbox)
+	if err != nil {
+		return nil, err
+	}
+	status.TotalMessages, err = m.TotalMessages(mbox)
+	if err != nil {
+		return nil, err
+	}
+	status.RecentMessages, err = m.RecentMessages(mbox)
+	if err != nil {
+		return nil, err
+	}
+	status.NextUid, err = m.NextUid(mbox)
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// ModSeqMailstore is implemented by mailstores that keep a modification
+// sequence for their mailboxes (a step towards CONDSTORE, RFC 4551)
+type ModSeqMailstore interface {
+	// HighestModSeq gets the highest modification sequence in an IMAP mailbox
+	HighestModSeq(mbox int64) (uint64, error)
+}
+
 // DummyMailstore is used for demonstrating the IMAP server
 type dummyMailstore struct {
 }
@@ -9,6 +9,9 @@ import (
 // parser can parse IMAP commands
 type parser struct {
 	lexer *lexer
+	// tag and commandName of the last command read
+	tag         string
+	commandName string
 }
 
 // parseError is an Error from the IMAP parser or lexer
@@ -35,10 +38,39 @@ func (p *parser) next() command {
 
 	// Expect a tag followed by a command
 	tag := p.expectString(p.lexer.tag)
+	p.tag = tag
+	p.commandName = ""
+
+	return p.command(tag)
+}
+
+// command parses the command that follows a tag
+// If the command is malformed, the rest of it is skipped and a command that
+// responds BAD to the tag is returned
+func (p *parser) command(tag string) (cmd command) {
+
+	defer func() {
+		if e := recover(); e != nil {
+			err, isParseError := e.(parseError)
+			if !isParseError {
+				panic(e)
+			}
+
+			// Failures to read a line are fatal
+			if p.lexer.failed {
+				panic(e)
+			}
+
+			p.lexer.skipLine()
+			cmd = &parseFailure{tag: tag, err: err}
+		}
+	}()
+
 	rawCommand := p.expectString(p.lexer.astring)
 
 	// Parse the command based on its lowercase value
 	lcCommand := strings.ToLower(rawCommand)
+	p.commandName = strings.ToUpper(rawCommand)
 
 	switch lcCommand {
 	case "noop":
@@ -51,6 +83,8 @@ func (p *parser) next() command {
 		return p.login(tag)
 	case "logout":
 		return p.logout(tag)
+	case "unauthenticate":
+		return p.unauthenticate(tag)
 	case "select":
 		return p.selectCmd(tag)
 	case "list":
@@ -91,6 +125,11 @@ func (p *parser) logout(tag string) command {
 	return &logout{tag: tag}
 }
 
+// unauthenticate creates an UNAUTHENTICATE command
+func (p *parser) unauthenticate(tag string) command {
+	return &unauthenticate{tag: tag}
+}
+
 // selectCmd creates a select command
 func (p *parser) selectCmd(tag string) command {
 
@@ -116,6 +155,11 @@ func (p *parser) list(tag string) command {
 
 // unknown creates a placeholder for an unknown command
 func (p *parser) unknown(tag string, cmd string) command {
+
+	// Skip the arguments, which may include literals that must not be
+	// mistaken for the next command
+	p.lexer.skipLine()
+
 	return &unknown{tag: tag, cmd: cmd}
 }
 
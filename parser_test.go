@@ -0,0 +1,115 @@
+package imapsrv
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// FuzzParseCommand checks the parser only ever panics with a parseError
+func FuzzParseCommand(f *testing.F) {
+	for _, seed := range []string{
+		"a1 NOOP\r\n",
+		"a1 CAPABILITY\r\n",
+		"a1 LOGIN bob secret\r\n",
+		"a1 LOGIN \"bob\" {6}\r\nsecret\r\n",
+		"a1 LOGIN {0}\r\n {0}\r\n\r\n",
+		"a1 SELECT inbox\r\n",
+		"a1 LIST \"\" \"*\"\r\n",
+		"a1 LIST inbox %\r\n",
+		"a1 STARTTLS\r\n",
+		"a1 UNAUTHENTICATE\r\n",
+		"a1 LOGOUT\n",
+		"a1 SEARCH SUBJECT \"a \\\"b\\\"\" FROM {3}\r\nbob ALL\r\n",
+		"quoted string\"\n",
+		"a1 \"\r\n",
+		"a1 {\r\n",
+		"\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := createParser(bufio.NewReader(bytes.NewReader(data)))
+
+		defer func() {
+			if e := recover(); e != nil {
+				if _, ok := e.(parseError); !ok {
+					t.Fatalf("Unexpected panic %v for %q", e, data)
+				}
+			}
+		}()
+
+		// Parse until the input runs out
+		for {
+			p.next()
+		}
+	})
+}
+
+// TestMalformedCommand checks a malformed command does not affect the next one
+func TestMalformedCommand(t *testing.T) {
+	p := createParser(bufio.NewReader(bytes.NewReader([]byte(
+		"a1 SELECT\r\n" +
+			"a2 NOOP\r\n" +
+			"a3 LOGIN \"bob {5}\r\na4 x\r\n" +
+			"a5 NOOP\r\n"))))
+
+	for _, expected := range []string{"a1", "a2", "a3", "a5"} {
+		cmd := p.next()
+		if p.tag != expected {
+			t.Fatalf("Unexpected tag %q, expected %q", p.tag, expected)
+		}
+
+		_, isFailure := cmd.(*parseFailure)
+		if isFailure != (expected == "a1" || expected == "a3") {
+			t.Errorf("Unexpected command %#v for %q", cmd, expected)
+		}
+	}
+}
+
+// TestLineFailureAfterLiteral checks that failing to read the line after a
+// literal is fatal rather than skipping the following commands
+func TestLineFailureAfterLiteral(t *testing.T) {
+	tests := []struct {
+		input         string
+		maxLineLength int
+	}{
+		{"a1 SELECT {3}\r\nabc\rX\r\na2 NOOP\r\na3 NOOP\r\n", 0},
+		{"a1 SELECT {3}\r\nabc " + strings.Repeat("x", 100) + "\r\na2 NOOP\r\na3 NOOP\r\n", 64},
+	}
+
+	for _, test := range tests {
+		p := createParser(bufio.NewReader(strings.NewReader(test.input)))
+		p.lexer.maxLineLength = test.maxLineLength
+
+		func() {
+			defer func() {
+				if _, ok := recover().(parseError); !ok {
+					t.Errorf("Expected a fatal parse error for %q", test.input)
+				}
+			}()
+			cmd := p.next()
+			t.Errorf("Unexpected command %#v for %q", cmd, test.input)
+		}()
+	}
+}
+
+// TestParseUnknownCommandLiteral checks the literal arguments of an unknown
+// command are skipped
+func TestParseUnknownCommandLiteral(t *testing.T) {
+	p := createParser(bufio.NewReader(bytes.NewReader([]byte(
+		"a1 XUNKNOWN {5}\r\nABCDE\r\n" +
+			"a2 NOOP\r\n"))))
+
+	cmd := p.next()
+	if _, ok := cmd.(*unknown); !ok || p.tag != "a1" {
+		t.Errorf("Unexpected command %#v for %q", cmd, p.tag)
+	}
+
+	cmd = p.next()
+	if _, ok := cmd.(*noop); !ok || p.tag != "a2" {
+		t.Errorf("Unexpected command %#v for %q", cmd, p.tag)
+	}
+}
@@ -2,7 +2,9 @@ package imapsrv
 
 import (
 	"bufio"
+	"io"
 	"net/textproto"
+	"strings"
 )
 
 // response represents an IMAP response
@@ -46,7 +48,7 @@ func no(tag string, message string) *response {
 	return createResponse(tag, "NO", message)
 }
 
-// empty creates an empty response
+// empty creates an empty response, nothing is written for it
 func empty() *response {
 	return &response{}
 }
@@ -58,6 +60,12 @@ func fatalResponse(w *bufio.Writer, err error) {
 	resp.write(w)
 }
 
+// quoted formats data as an IMAP quoted string
+func quoted(data string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(data)
+	return `"` + escaped + `"`
+}
+
 // extra adds an untagged line to a response
 func (r *response) extra(line string) *response {
 	r.untagged = append(r.untagged, line)
@@ -76,23 +84,37 @@ func (r *response) replaceBuffers(replacement *textproto.Conn) *response {
 	return r
 }
 
-// write will write a response to the given writer
-func (r *response) write(w *bufio.Writer) error {
+// encode writes the response as it is sent on the wire, a line at a time
+// so that large responses are not built up in memory
+func (r *response) encode(w io.Writer) error {
 
-	// Write untagged lines
+	// Untagged lines
 	for _, line := range r.untagged {
-		_, err := w.WriteString("* " + line + "\r\n")
+		_, err := io.WriteString(w, "* "+line+"\r\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	// Tagged line, empty responses have none
+	if r.tag != "" {
+		_, err := io.WriteString(w, r.tag+" "+r.condition+" "+r.message+"\r\n")
 		if err != nil {
 			return err
 		}
 	}
 
-	_, err := w.WriteString(r.tag + " " + r.condition + " " + r.message + "\r\n")
+	return nil
+}
+
+// write will write a response to the given writer
+func (r *response) write(w *bufio.Writer) error {
+
+	err := r.encode(w)
 	if err != nil {
 		return err
 	}
 
 	// Flush the response
-	w.Flush()
-	return nil
+	return w.Flush()
 }
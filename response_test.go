@@ -0,0 +1,44 @@
+package imapsrv
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// encodeString returns a response as it is sent on the wire
+func encodeString(r *response) string {
+	var buf bytes.Buffer
+	r.encode(&buf)
+	return buf.String()
+}
+
+func TestEncodeResponse(t *testing.T) {
+
+	resp := ok("A001", "SELECT completed").
+		extra("8 EXISTS").
+		extra("OK [UIDNEXT 9] Predicted next UID")
+
+	expected := "* 8 EXISTS\r\n" +
+		"* OK [UIDNEXT 9] Predicted next UID\r\n" +
+		"A001 OK SELECT completed\r\n"
+
+	if encodeString(resp) != expected {
+		t.Errorf("Unexpected encoding %q", encodeString(resp))
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+
+	var buf bytes.Buffer
+	resp := no("A002", "LOGIN failure")
+
+	err := resp.write(bufio.NewWriter(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != encodeString(resp) || buf.String() != "A002 NO LOGIN failure\r\n" {
+		t.Errorf("Unexpected output %q", buf.String())
+	}
+}
@@ -0,0 +1,29 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package imapsrv
+
+import (
+	"testing"
+)
+
+// TestReusePort checks two servers can listen on the same address
+func TestReusePort(t *testing.T) {
+	first := NewServer(ListenOption("127.0.0.1:0"), StoreOption(&TestMailstore{}), ReusePortOption())
+	err := first.ListenAndServe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Stop()
+	addr := first.config.listeners[0].listener.Addr().String()
+
+	second := NewServer(ListenOption(addr), StoreOption(&TestMailstore{}), ReusePortOption())
+	err = second.ListenAndServe()
+	if err != nil {
+		t.Fatalf("Expected a second listener on %s, got %v", addr, err)
+	}
+	defer second.Stop()
+
+	// Either server can answer
+	conn, _ := dialTestServer(t, addr)
+	conn.Close()
+}
@@ -1,9 +1,12 @@
 package imapsrv
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
+	"time"
 )
 
 // state is the IMAP session state
@@ -32,6 +35,8 @@ type session struct {
 	id string
 	// st indicates the current state of the session
 	st state
+	// user is the authenticated user (if st != notAuthenticated)
+	user string
 	// mailbox is the currently selected mailbox (if st == selected)
 	mailbox *Mailbox
 	// config refers to the IMAP configuration
@@ -44,6 +49,11 @@ type session struct {
 	conn net.Conn
 	// tls indicates whether or not the communication is encrypted
 	encryption encryptionLevel
+	// tlsState is the negotiated TLS connection, nil before TLS is negotiated
+	tlsState *tls.ConnectionState
+	// ctx is cancelled when the session's connection is closed, long running
+	// commands should stop when it is done
+	ctx context.Context
 }
 
 // Create a new IMAP session
@@ -55,6 +65,30 @@ func createSession(id string, config *config, server *Server, listener *listener
 		server:   server,
 		listener: listener,
 		conn:     conn,
+		ctx:      context.Background(),
+	}
+}
+
+// setTLS records that the session is using the given TLS connection, which
+// must have completed its handshake
+func (s *session) setTLS(conn *tls.Conn) {
+	state := conn.ConnectionState()
+	s.conn = conn
+	s.encryption = tlsLevel
+	s.tlsState = &state
+}
+
+// connectionState gets the negotiated TLS connection, or nil if the
+// session is not using TLS
+func (s *session) connectionState() *tls.ConnectionState {
+	return s.tlsState
+}
+
+// close releases the resources held by the session
+func (s *session) close() {
+	if s.user != "" {
+		s.server.releaseUser(s.user)
+		s.user = ""
 	}
 }
 
@@ -66,23 +100,65 @@ func (s *session) log(info ...interface{}) {
 	log.Print(message...)
 }
 
-// selectMailbox selects a mailbox - returns true if the mailbox exists
-func (s *session) selectMailbox(path []string) (bool, error) {
+// loginDisabled returns true if plaintext authentication is not allowed
+func (s *session) loginDisabled() bool {
+	return s.listener.encryption == starttlsLevel &&
+		s.encryption != tlsLevel &&
+		!s.listener.allowPlainAuth
+}
+
+// privacyRequired returns true if the command must not run before TLS is negotiated
+func (s *session) privacyRequired(cmd command) bool {
+	if !s.config.requireTLS ||
+		s.listener.encryption != starttlsLevel ||
+		s.listener.allowPlainAuth ||
+		s.encryption == tlsLevel {
+		return false
+	}
+
+	switch cmd.(type) {
+	case *capability, *starttls, *noop, *logout:
+		return false
+	case *unknown, *parseFailure:
+		// Errors in the command are reported before privacy
+		return false
+	default:
+		return true
+	}
+}
+
+// audit logs the outcome of a command
+// Command arguments are never logged as they can contain credentials
+func (s *session) audit(commandName string, resp *response, elapsed time.Duration) {
+	message := fmt.Sprintf("user=%q command=%s tag=%q result=%s elapsed=%v",
+		s.user, commandName, resp.tag, resp.condition, elapsed)
+
+	if state := s.connectionState(); state != nil {
+		message += fmt.Sprintf(" tls=%q cipher=%s",
+			tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	}
+	s.log(message)
+}
+
+// selectMailbox selects a mailbox - returns the mailbox or nil if it does not exist
+// A mailbox with the Noselect flag is returned but not selected
+func (s *session) selectMailbox(path []string) (*Mailbox, error) {
 	// Lookup the mailbox
 	mailstore := s.config.mailstore
 	mbox, err := mailstore.GetMailbox(path)
 
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	if mbox == nil {
-		return false, nil
+	if mbox == nil || !mbox.Selectable() {
+		return mbox, nil
 	}
 
 	// Make note of the mailbox
 	s.mailbox = mbox
-	return true, nil
+	s.st = selected
+	return mbox, nil
 }
 
 // list mailboxes matching the given mailbox pattern
@@ -104,7 +180,7 @@ func (s *session) list(reference []string, pattern []string) ([]*Mailbox, error)
 	// Just return a single mailbox if there are no wildcards
 	if wildcard == -1 {
 		mbox, err := s.config.mailstore.GetMailbox(path)
-		if err != nil {
+		if err != nil || mbox == nil {
 			return ret, err
 		}
 		ret = append(ret, mbox)
@@ -120,28 +196,30 @@ func (s *session) addMailboxInfo(resp *response) error {
 	mailstore := s.config.mailstore
 
 	// Get the mailbox information from the mailstore
-	firstUnseen, err := mailstore.FirstUnseen(s.mailbox.Id)
+	status, err := mailboxStatus(mailstore, s.mailbox.Id)
 	if err != nil {
 		return err
 	}
-	totalMessages, err := mailstore.TotalMessages(s.mailbox.Id)
-	if err != nil {
-		return err
-	}
-	recentMessages, err := mailstore.RecentMessages(s.mailbox.Id)
-	if err != nil {
-		return err
+
+	resp.extra(fmt.Sprint(status.TotalMessages, " EXISTS"))
+	resp.extra(fmt.Sprint(status.RecentMessages, " RECENT"))
+
+	// There is no UNSEEN response when all messages have been seen
+	if status.FirstUnseen > 0 {
+		resp.extra(fmt.Sprintf("OK [UNSEEN %d] Message %d is first unseen", status.FirstUnseen, status.FirstUnseen))
 	}
-	nextUid, err := mailstore.NextUid(s.mailbox.Id)
-	if err != nil {
-		return err
+	resp.extra(fmt.Sprintf("OK [UIDVALIDITY %d] UIDs valid", s.mailbox.Id))
+	resp.extra(fmt.Sprintf("OK [UIDNEXT %d] Predicted next UID", status.NextUid))
+
+	// Report the modification sequence if the mailstore keeps one
+	if modSeqStore, ok := mailstore.(ModSeqMailstore); ok {
+		highestModSeq, err := modSeqStore.HighestModSeq(s.mailbox.Id)
+		if err != nil {
+			return err
+		}
+		resp.extra(fmt.Sprintf("OK [HIGHESTMODSEQ %d] Highest", highestModSeq))
 	}
 
-	resp.extra(fmt.Sprint(totalMessages, " EXISTS"))
-	resp.extra(fmt.Sprint(recentMessages, " RECENT"))
-	resp.extra(fmt.Sprintf("OK [UNSEEN %d] Message %d is first unseen", firstUnseen, firstUnseen))
-	resp.extra(fmt.Sprintf("OK [UIDVALIDITY %d] UIDs valid", s.mailbox.Id))
-	resp.extra(fmt.Sprintf("OK [UIDNEXT %d] Predicted next UID", nextUid))
 	return nil
 }
 
@@ -159,6 +237,11 @@ func (s *session) depthFirstMailboxes(
 
 	mailstore := s.config.mailstore
 
+	// Stop if the client has gone
+	if err := s.ctx.Err(); err != nil {
+		return results, err
+	}
+
 	// Stop recursing if the pattern is empty or if the path is too long
 	if len(pattern) == 0 || len(path) > 20 {
 		return results, nil
@@ -166,13 +249,14 @@ func (s *session) depthFirstMailboxes(
 
 	// Consider the next part of the pattern
 	ret := results
+	var all []*Mailbox
 	var err error
 	pat := pattern[0]
 
 	switch pat {
 	case "%":
 		// Get all the mailboxes at the current path
-		all, err := mailstore.GetMailboxes(path)
+		all, err = mailstore.GetMailboxes(path)
 		if err == nil {
 			for _, mbox := range all {
 				// Consider the next pattern
@@ -186,7 +270,7 @@ func (s *session) depthFirstMailboxes(
 
 	case "*":
 		// Get all the mailboxes at the current path
-		all, err := mailstore.GetMailboxes(path)
+		all, err = mailstore.GetMailboxes(path)
 		if err == nil {
 			for _, mbox := range all {
 				// Keep using this pattern
@@ -200,8 +284,9 @@ func (s *session) depthFirstMailboxes(
 
 	default:
 		// Not a wildcard pattern
-		mbox, err := mailstore.GetMailbox(path)
-		if err == nil {
+		var mbox *Mailbox
+		mbox, err = mailstore.GetMailbox(path)
+		if err == nil && mbox != nil {
 			ret = append(results, mbox)
 			ret, err = s.depthFirstMailboxes(ret, mbox.Path, pattern)
 		}